@@ -0,0 +1,220 @@
+/*
+ *  Copyright (c) 2011 NeuStar, Inc.
+ *  All rights reserved.
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  NeuStar, the Neustar logo and related names and logos are registered
+ *  trademarks, service marks or tradenames of NeuStar, Inc. All other
+ *  product names, company names, marks, logos and symbols may be trademarks
+ *  of their respective owners.
+ */
+
+// Package appender ships application log lines to a kafka topic, like the scala
+// KafkaLog4jAppender, as an io.Writer (for the log package) or a slog.Handler
+package appender
+
+import (
+	"bytes"
+	kafka "github.com/apache/kafka/clients/gokafka"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Appender is an io.Writer that publishes each line written to it as a message,
+// batched by a buffered sender.  Writes never block longer than MaxBlock: if the
+// queue is full the line goes to the fallback file, and lines the broker could
+// not be sent to also go to the fallback file.  Without a fallback file they are
+// dropped and counted.
+type Appender struct {
+	Topic string
+
+	sender   kafka.MessageSender
+	queue    chan []byte
+	maxBlock time.Duration
+	done     chan bool
+	wg       sync.WaitGroup
+	// stops the buffered sender, which closes senderDone once its connection is closed
+	stopSender chan bool
+	senderDone chan bool
+
+	fallbackMu sync.Mutex
+	fallback   *os.File
+	dropped    uint64
+}
+
+// Options for an Appender, the zero value of each field uses the default
+type Options struct {
+	// lines queued for the sender before writes start to block, default 1000
+	QueueSize int
+	// max time a write blocks when the queue is full, default 0 (never blocks)
+	MaxBlock time.Duration
+	// ms to buffer lines before publishing, default 1000
+	BufferMaxMs int64
+	// lines to buffer before publishing, default 200
+	BufferMaxSize int
+	// file to append lines to that can't be queued or sent, empty drops them
+	FallbackFile string
+}
+
+// Create an appender publishing to topic through broker (see kafka.NewRandomPartitionedBroker).
+// The broker's SendErrorHandler is wrapped to write failed sends to the fallback file, any
+// handler already set is still called
+func New(broker *kafka.Broker, topic string, opts Options) (*Appender, error) {
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = 1000
+	}
+	if opts.BufferMaxMs <= 0 {
+		opts.BufferMaxMs = 1000
+	}
+	if opts.BufferMaxSize <= 0 {
+		opts.BufferMaxSize = 200
+	}
+
+	a := &Appender{
+		Topic:      topic,
+		queue:      make(chan []byte, opts.QueueSize),
+		maxBlock:   opts.MaxBlock,
+		done:       make(chan bool),
+		stopSender: make(chan bool),
+	}
+	if len(opts.FallbackFile) > 0 {
+		file, err := os.OpenFile(opts.FallbackFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		a.fallback = file
+	}
+
+	previous := broker.SendErrorHandler
+	broker.SendErrorHandler = func(msgs []*kafka.MessageTopic, err error) {
+		for _, msg := range msgs {
+			a.writeFallback(msg.Message.Payload())
+		}
+		if previous != nil {
+			previous(msgs, err)
+		}
+	}
+	// the sender keeps retrying to connect, so a broker that is down is not an error
+	sender, senderDone, err := kafka.NewBufferedSenderWithQuit(broker, opts.BufferMaxMs, opts.BufferMaxSize, a.stopSender)
+	if err != nil {
+		a.closeFallback()
+		return nil, err
+	}
+	a.sender, a.senderDone = sender, senderDone
+
+	a.wg.Add(1)
+	go a.run()
+	return a, nil
+}
+
+func (a *Appender) run() {
+	defer a.wg.Done()
+	for {
+		select {
+		case line := <-a.queue:
+			a.send(line)
+		case <-a.done:
+			for {
+				select {
+				case line := <-a.queue:
+					a.send(line)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (a *Appender) send(line []byte) {
+	a.sender(&kafka.MessageTopic{Topic: a.Topic, Partition: -1, Message: kafka.NewMessage(line)})
+}
+
+// Write queues each line of p to be published, it is safe for concurrent use
+func (a *Appender) Write(p []byte) (int, error) {
+	for _, line := range bytes.Split(bytes.TrimRight(p, "\n"), []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		// the caller may reuse p
+		a.enqueue(append([]byte(nil), line...))
+	}
+	return len(p), nil
+}
+
+func (a *Appender) enqueue(line []byte) {
+	select {
+	case a.queue <- line:
+		return
+	default:
+	}
+	if a.maxBlock > 0 {
+		timer := time.NewTimer(a.maxBlock)
+		defer timer.Stop()
+		select {
+		case a.queue <- line:
+			return
+		case <-timer.C:
+		}
+	}
+	a.writeFallback(line)
+}
+
+func (a *Appender) writeFallback(line []byte) {
+	a.fallbackMu.Lock()
+	defer a.fallbackMu.Unlock()
+	if a.fallback == nil {
+		atomic.AddUint64(&a.dropped, 1)
+		return
+	}
+	if _, err := a.fallback.Write(line); err != nil {
+		atomic.AddUint64(&a.dropped, 1)
+		return
+	}
+	a.fallback.Write([]byte{'\n'})
+}
+
+func (a *Appender) closeFallback() {
+	a.fallbackMu.Lock()
+	defer a.fallbackMu.Unlock()
+	if a.fallback != nil {
+		a.fallback.Close()
+		a.fallback = nil
+	}
+}
+
+// The number of lines that could not be published or written to the fallback file
+func (a *Appender) Dropped() uint64 {
+	return atomic.LoadUint64(&a.dropped)
+}
+
+// Publish the queued lines and close the connection and fallback file, the
+// appender must not be written to after
+func (a *Appender) Close() error {
+	close(a.done)
+	a.wg.Wait()
+	// the sender publishes what it has buffered and closes its connection
+	close(a.stopSender)
+	<-a.senderDone
+	a.closeFallback()
+	return nil
+}
+
+// A slog.Handler writing each record as a json line to the appender
+func NewHandler(a *Appender, opts *slog.HandlerOptions) slog.Handler {
+	return slog.NewJSONHandler(a, opts)
+}
@@ -0,0 +1,132 @@
+/*
+ *  Copyright (c) 2011 NeuStar, Inc.
+ *  All rights reserved.
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  NeuStar, the Neustar logo and related names and logos are registered
+ *  trademarks, service marks or tradenames of NeuStar, Inc. All other
+ *  product names, company names, marks, logos and symbols may be trademarks
+ *  of their respective owners.
+ */
+
+package appender
+
+import (
+	"io"
+	kafka "github.com/apache/kafka/clients/gokafka"
+	"log"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAppenderFallback(t *testing.T) {
+	fallback := filepath.Join(t.TempDir(), "fallback.log")
+	// nothing listens on port 1, so every send fails over to the fallback file
+	broker := kafka.NewRandomPartitionedBroker("localhost:1", "logs", []int{0})
+	failed := 0
+	broker.SendErrorHandler = func(msgs []*kafka.MessageTopic, err error) {
+		failed += len(msgs)
+	}
+	a, err := New(broker, "logs", Options{BufferMaxMs: 10, FallbackFile: fallback})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := log.New(a, "", 0)
+	logger.Println("first line")
+	logger.Println("second line")
+	slog.New(NewHandler(a, nil)).Info("structured", "user", "bob")
+	if err = a.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(fallback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 3 || lines[0] != "first line" || lines[1] != "second line" {
+		t.Fatalf("fallback file incorrect %q", string(data))
+	}
+	if !strings.Contains(lines[2], `"msg":"structured"`) || !strings.Contains(lines[2], `"user":"bob"`) {
+		t.Fatalf("slog record incorrect %s", lines[2])
+	}
+	if a.Dropped() != 0 {
+		t.Fatalf("expected no dropped lines, got %d", a.Dropped())
+	}
+	if failed != 3 {
+		t.Fatalf("the brokers own SendErrorHandler should still be called, got %d", failed)
+	}
+}
+
+func TestAppenderDropsWithoutFallback(t *testing.T) {
+	broker := kafka.NewRandomPartitionedBroker("localhost:1", "logs", []int{0})
+	a, err := New(broker, "logs", Options{BufferMaxMs: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Write([]byte("one\ntwo\n"))
+	a.Close()
+	if a.Dropped() != 2 {
+		t.Fatalf("expected 2 dropped lines, got %d", a.Dropped())
+	}
+}
+
+func TestAppenderClosesReconnectedConnection(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	// the first connect fails, the sender connects on its first send
+	broker := kafka.NewRandomPartitionedBroker(addr, "logs", []int{0})
+	a, err := New(broker, "logs", Options{BufferMaxMs: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if listener, err = net.Listen("tcp", addr); err != nil {
+		a.Close()
+		t.Skipf("could not listen on %s again %v", addr, err)
+	}
+	defer listener.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// returns once the appender closes the connection
+		request, _ := io.ReadAll(conn)
+		received <- request
+	}()
+
+	a.Write([]byte("line\n"))
+	a.Close()
+	select {
+	case request := <-received:
+		if !strings.Contains(string(request), "line") {
+			t.Fatalf("line was not published before closing %q", request)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the senders connection was not closed")
+	}
+}
@@ -0,0 +1,205 @@
+/*
+ *  Copyright (c) 2011 NeuStar, Inc.
+ *  All rights reserved.
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  NeuStar, the Neustar logo and related names and logos are registered
+ *  trademarks, service marks or tradenames of NeuStar, Inc. All other
+ *  product names, company names, marks, logos and symbols may be trademarks
+ *  of their respective owners.
+ */
+
+package kafka
+
+import (
+	"time"
+)
+
+// The offsets of one topic/partition in a batch
+type OffsetRange struct {
+	Topic     string
+	Partition int
+	// offset of the first message in the batch
+	FirstOffset uint64
+	// offset to consume from to continue after the batch
+	NextOffset uint64
+	Count      int
+}
+
+// Messages handed to a BatchHandlerFunc, with the offset range of each topic/partition
+type MessageBatch struct {
+	Messages []*MessageAndMetadata
+	Ranges   []*OffsetRange
+}
+
+// Handles a batch of messages, the consumer offsets only advance past the batch if
+// it returns nil
+type BatchHandlerFunc func(batch *MessageBatch) error
+
+func newMessageBatch(msgs []*MessageAndMetadata) *MessageBatch {
+	batch := &MessageBatch{Messages: msgs, Ranges: make([]*OffsetRange, 0)}
+	ranges := make(map[string]map[int]*OffsetRange)
+	for _, mm := range msgs {
+		if ranges[mm.Topic] == nil {
+			ranges[mm.Topic] = make(map[int]*OffsetRange)
+		}
+		r := ranges[mm.Topic][mm.Partition]
+		if r == nil {
+			r = &OffsetRange{Topic: mm.Topic, Partition: mm.Partition, FirstOffset: mm.Offset}
+			ranges[mm.Topic][mm.Partition] = r
+			batch.Ranges = append(batch.Ranges, r)
+		}
+		r.NextOffset = mm.NextOffset
+		r.Count++
+	}
+	return batch
+}
+
+// the offsets of the consumers topic/partitions, before any batch that failed
+type committedOffsets map[*TopicPartition]uint64
+
+func (consumer *BrokerConsumer) committedOffsets() committedOffsets {
+	committed := make(committedOffsets)
+	for _, tp := range consumer.broker.assignedTopics() {
+		committed[tp] = consumer.broker.offset(tp)
+	}
+	return committed
+}
+
+// add the topic/partition of a fetched message, if it was assigned after the offsets were
+// taken, from the offset of its message set
+func (committed committedOffsets) track(broker *Broker, mm *MessageAndMetadata) {
+	broker.mu.Lock()
+	tp := broker.assigned(mm.Topic, mm.Partition)
+	broker.mu.Unlock()
+	if _, ok := committed[tp]; tp != nil && !ok {
+		committed[tp] = mm.Offset
+	}
+}
+
+// advance past a handled batch
+func (committed committedOffsets) commit(batch *MessageBatch) {
+	for tp := range committed {
+		for _, r := range batch.Ranges {
+			if r.Topic == tp.Topic && r.Partition == tp.Partition {
+				committed[tp] = r.NextOffset
+			}
+		}
+	}
+}
+
+// go back to the last handled batch, so the next fetch gets the failed messages again
+func (committed committedOffsets) rewind(broker *Broker) {
+	for tp, offset := range committed {
+		broker.setOffset(tp, offset)
+	}
+}
+
+// Consume a message set for each topic/partition, calling handler once with all the
+// messages of the fetch response.  If handler returns an error the offsets are not
+// advanced, and the error is returned
+func (consumer *BrokerConsumer) ConsumeBatch(handler BatchHandlerFunc) (int, error) {
+	committed := consumer.committedOffsets()
+	msgs := make([]*MessageAndMetadata, 0)
+	num, err := consumer.fetch(func(mm *MessageAndMetadata) {
+		msgs = append(msgs, mm)
+	})
+	if len(msgs) == 0 {
+		return num, err
+	}
+	if herr := handler(newMessageBatch(msgs)); herr != nil {
+		committed.rewind(consumer.broker)
+		return 0, herr
+	}
+	return num, err
+}
+
+// Consume until quit, calling handler with batches of up to maxMessages messages, or
+// what has arrived after maxWaitMs.  A maxMessages of 0 or less is one batch per fetch
+// response.  If handler returns an error the offsets are rewound to the end of the last
+// handled batch and the error is returned, on quit they are rewound past any messages
+// not yet handled, including partitions assigned while it runs.  A batch can end inside
+// a compressed message set, so the next fetch after a rewind may repeat messages already
+// handled.  The handler may keep a batch, its messages are not reused
+func (consumer *BrokerConsumer) ConsumeBatches(handler BatchHandlerFunc, maxMessages int, maxWaitMs int64,
+	quit chan bool) (int, error) {
+
+	maxWait := time.Duration(maxWaitMs) * time.Millisecond
+	committed := consumer.committedOffsets()
+	pending := make([]*MessageAndMetadata, 0)
+	var deadline time.Time
+	num := 0
+
+	flush := func(msgs []*MessageAndMetadata) error {
+		batch := newMessageBatch(msgs)
+		if err := handler(batch); err != nil {
+			committed.rewind(consumer.broker)
+			return err
+		}
+		committed.commit(batch)
+		num += len(msgs)
+		return nil
+	}
+
+	for {
+		select {
+		case <-quit:
+			committed.rewind(consumer.broker)
+			return num, nil
+		default:
+		}
+
+		fetched, err := consumer.fetch(func(mm *MessageAndMetadata) {
+			committed.track(consumer.broker, mm)
+			if len(pending) == 0 {
+				deadline = time.Now().Add(maxWait)
+			}
+			pending = append(pending, mm)
+		})
+		if err != nil && fetched <= 0 {
+			consumer.broker.Logger.Debug("batch fetch returned no messages", "host", consumer.broker.hostname, "err", err)
+		}
+
+		for maxMessages > 0 && len(pending) >= maxMessages {
+			if err = flush(pending[:maxMessages]); err != nil {
+				return num, err
+			}
+			// the handler may keep the batch, so its messages aren't reused
+			pending = append(make([]*MessageAndMetadata, 0, maxMessages), pending[maxMessages:]...)
+			deadline = time.Now().Add(maxWait)
+		}
+		if len(pending) > 0 && (maxMessages <= 0 || !time.Now().Before(deadline)) {
+			if err = flush(pending); err != nil {
+				return num, err
+			}
+			pending = nil
+		}
+
+		if fetched <= 0 {
+			wait := maxWait
+			if len(pending) > 0 {
+				wait = time.Until(deadline)
+			}
+			if wait <= 0 {
+				wait = 10 * time.Millisecond
+			}
+			select {
+			case <-quit:
+				committed.rewind(consumer.broker)
+				return num, nil
+			case <-time.After(wait):
+			}
+		}
+	}
+}
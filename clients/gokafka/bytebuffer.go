@@ -28,7 +28,6 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
 )
 
 /*
@@ -56,11 +55,12 @@ type ByteBuffer struct {
 	reader   *bufio.Reader
 	Size     uint32
 	consumed uint32
+	logger   Logger
 	//msgs   []*Message
 }
 
 func NewByteBuffer(ct int, buf *bufio.Reader) *ByteBuffer {
-	b := ByteBuffer{ct: ct, reader: buf}
+	b := ByteBuffer{ct: ct, reader: buf, logger: NoopLogger{}}
 	return &b
 }
 
@@ -78,7 +78,7 @@ func (b *ByteBuffer) firstRead() (uint32, uint16, error) {
 	length := make([]byte, 4)
 	lenRead, err := io.ReadFull(b.reader, length)
 	if err != nil {
-		log.Println("invalid socket read ", err)
+		b.logger.Error("invalid socket read", "err", err)
 		return 0, 0, err
 	}
 	if lenRead != 4 || lenRead < 0 {
@@ -121,7 +121,17 @@ func (b *ByteBuffer) ReadHeader() (error, int) {
 	return errors.New(fmt.Sprintf("could not read header %d", errorCode)), int(errorCode)
 }
 
-// Read the length and error for this set (message/offset)
+// The error code of a message set in a broker response, 1 is an offset out of range
+type BrokerResponseError struct {
+	Code int
+}
+
+func (e *BrokerResponseError) Error() string {
+	return fmt.Sprintf("Broker Response Error: %d", e.Code)
+}
+
+// Read the length and error for this set (message/offset), a set with an error code
+// returns a BrokerResponseError
 func (b *ByteBuffer) ReadSet() (int, error) {
 
 	//log.Println(b.reader.Peek(30))
@@ -129,7 +139,10 @@ func (b *ByteBuffer) ReadSet() (int, error) {
 	size, errorCode, err := b.firstRead()
 	b.consumed += 6
 	if errorCode != 0 || err != nil {
-		log.Println("errorCode: ", errorCode)
+		b.logger.Error("broker response error", "errorcode", errorCode, "err", err)
+		if err == nil {
+			return 0, &BrokerResponseError{Code: int(errorCode)}
+		}
 		return 0, errors.New(fmt.Sprintf("Broker Response Error: %d", errorCode))
 	}
 	return int(size), nil
@@ -148,7 +161,7 @@ func (b *ByteBuffer) NextMsg(payloadCodecsMap map[byte]PayloadCodec) (int, []*Me
 	b.consumed += 4
 	//log.Println("after len")
 	if err != nil {
-		log.Println("invalid socket read ", err)
+		b.logger.Error("invalid socket read", "err", err)
 		return 0, nil, err
 	}
 	if lenRead != 4 {
@@ -172,14 +185,14 @@ func (b *ByteBuffer) NextMsg(payloadCodecsMap map[byte]PayloadCodec) (int, []*Me
 		return 0, nil, err
 	}
 	if uint32(lenRead) != expectedLength {
-		log.Println("\033[0m\033[31m", lenRead, " ", expectedLength, "\033[0m")
+		b.logger.Error("short payload read", "read", lenRead, "expected", expectedLength)
 		return 0, nil, errors.New("Did not read enough data from buffer?")
 	}
 	b.consumed += expectedLength
 	//log.Println(payload, expectedLength)
 	// TODO, revamp Decode to not read len (seperate payload/len)
 	payload = append(length, payload...)
-	payloadConsumed, msgs := Decode(payload, payloadCodecsMap)
+	payloadConsumed, msgs := decode(payload, payloadCodecsMap, b.logger)
 	if msgs == nil || len(msgs) == 0 {
 		// this isn't invalid as large messages might contain partial messages 
 		return 0, []*Message{}, err
@@ -196,7 +209,7 @@ func (b *ByteBuffer) Payload() ([]byte, error) {
 	length := make([]byte, 4)
 	lenRead, err := io.ReadFull(b.reader, length)
 	if err != nil {
-		log.Println("invalid socket read ", err)
+		b.logger.Error("invalid socket read", "err", err)
 		return []byte{}, err
 	}
 	if lenRead != 4 || lenRead < 0 {
@@ -225,7 +238,7 @@ func (b *ByteBuffer) Offsets() ([]uint64, error) {
 	length := make([]byte, 4)
 	lenRead, err := io.ReadFull(b.reader, length)
 	if err != nil {
-		log.Println("invalid socket read ", err)
+		b.logger.Error("invalid socket read", "err", err)
 		return offsets, err
 	}
 	if lenRead != 4 || lenRead < 0 {
@@ -0,0 +1,100 @@
+/*
+ *  Copyright (c) 2011 NeuStar, Inc.
+ *  All rights reserved.
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  NeuStar, the Neustar logo and related names and logos are registered
+ *  trademarks, service marks or tradenames of NeuStar, Inc. All other
+ *  product names, company names, marks, logos and symbols may be trademarks
+ *  of their respective owners.
+ */
+
+package kafka
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// OffsetCheckpoint keeps the offsets of source topic/partitions in a local file, so
+// long running copies (mirror, replay) can restart where they left off
+type OffsetCheckpoint struct {
+	path    string
+	mu      sync.Mutex
+	offsets map[string]uint64
+}
+
+// Load a checkpoint file, a missing file is an empty checkpoint
+func LoadOffsetCheckpoint(path string) (*OffsetCheckpoint, error) {
+	c := &OffsetCheckpoint{path: path, offsets: make(map[string]uint64)}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &c.offsets); err != nil {
+		return nil, fmt.Errorf("invalid checkpoint %s: %v", path, err)
+	}
+	return c, nil
+}
+
+func checkpointKey(hostname string, topic string, partition int) string {
+	return fmt.Sprintf("%s/%s/%d", hostname, topic, partition)
+}
+
+// Get the checkpointed offset of a topic/partition on a broker
+func (c *OffsetCheckpoint) Offset(hostname string, tp *TopicPartition) (uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	offset, ok := c.offsets[checkpointKey(hostname, tp.Topic, tp.Partition)]
+	return offset, ok
+}
+
+// Set the offset of each topic/partition, call Save to persist it
+func (c *OffsetCheckpoint) Set(hostname string, tplist ...*TopicPartition) {
+	c.mu.Lock()
+	for _, tp := range tplist {
+		c.offsets[checkpointKey(hostname, tp.Topic, tp.Partition)] = tp.Offset
+	}
+	c.mu.Unlock()
+}
+
+// Write the checkpoint file, through a temp file so a crash never leaves a partial file
+func (c *OffsetCheckpoint) Save() error {
+	c.mu.Lock()
+	data, err := json.MarshalIndent(c.offsets, "", "  ")
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(c.path), filepath.Base(c.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), c.path)
+}
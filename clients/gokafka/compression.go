@@ -0,0 +1,162 @@
+/*
+ *  Copyright (c) 2011 NeuStar, Inc.
+ *  All rights reserved.
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  NeuStar, the Neustar logo and related names and logos are registered
+ *  trademarks, service marks or tradenames of NeuStar, Inc. All other
+ *  product names, company names, marks, logos and symbols may be trademarks
+ *  of their respective owners.
+ */
+
+package kafka
+
+import (
+	"fmt"
+)
+
+// CompressionPolicy chooses the codec the buffered sender compresses a topic's
+// batches with, nil or the NO_COMPRESSION codec leaves them uncompressed
+type CompressionPolicy func(topic string) PayloadCodec
+
+// Create a policy like the scala producer's compression.codec and compressed.topics:
+// codec is used for the listed topics, or for all topics if none are listed
+func NewCompressionPolicy(codec PayloadCodec, topics ...string) CompressionPolicy {
+	if codec == nil || codec.Id() == NO_COMPRESSION_ID {
+		return nil
+	}
+	if len(topics) == 0 {
+		return func(topic string) PayloadCodec {
+			return codec
+		}
+	}
+	compressed := make(map[string]bool, len(topics))
+	for _, topic := range topics {
+		compressed[topic] = true
+	}
+	return func(topic string) PayloadCodec {
+		if compressed[topic] {
+			return codec
+		}
+		return nil
+	}
+}
+
+// The error for a message, or compressed batch, over the producers MaxMessageSize,
+// which the broker would drop without a response
+type MessageSizeTooLargeError struct {
+	Topic     string
+	Partition int
+	Size      int
+	MaxSize   int
+}
+
+func (e *MessageSizeTooLargeError) Error() string {
+	return fmt.Sprintf("message size %d for %s:%d is larger than the max message size %d", e.Size, e.Topic,
+		e.Partition, e.MaxSize)
+}
+
+// a MessageSizeTooLargeError if the payload of msg is over MaxMessageSize.  The payload,
+// rather than the encoded message, is what the broker's max.message.size applies to: it
+// checks the payload size of each top level message of a message set, so for a compressed
+// batch the size of the compressed payload, and the message header isn't counted
+func (b *Broker) checkSize(topic string, partition int, msg *Message) error {
+	if b.MaxMessageSize > 0 && len(msg.payload) > b.MaxMessageSize {
+		return &MessageSizeTooLargeError{Topic: topic, Partition: partition, Size: len(msg.payload),
+			MaxSize: b.MaxMessageSize}
+	}
+	return nil
+}
+
+// The request to send for preq, with each batch compressed by the Compression policy.
+// Messages (or compressed batches) over MaxMessageSize are returned as rejected, with a
+// MessageSizeTooLargeError, unless SplitLargeBatches splits them into smaller batches
+func (b *Broker) wireRequest(preq ProduceRequest) (ProduceRequest, ProduceRequest, error) {
+	wire := make(ProduceRequest, len(preq))
+	rejected := make(ProduceRequest)
+	var err error
+	for topic, partMsgs := range preq {
+		var codec PayloadCodec
+		if b.Compression != nil {
+			codec = b.Compression(topic)
+		}
+		if codec != nil && codec.Id() == NO_COMPRESSION_ID {
+			codec = nil
+		}
+		for partition, messages := range partMsgs {
+			batch := make([]*MessageTopic, 0, len(messages))
+			var plain, tooLarge []*MessageTopic
+			// compress the run of uncompressed messages so far, keeping it in order with
+			// the messages around it
+			flush := func() {
+				if len(plain) == 0 {
+					return
+				}
+				compressed, uncompressible, sizeErr := b.compressBatch(codec, topic, partition, plain)
+				batch = append(batch, compressed...)
+				if len(uncompressible) > 0 {
+					tooLarge, err = append(tooLarge, uncompressible...), sizeErr
+				}
+				plain = nil
+			}
+			for _, msg := range messages {
+				if codec != nil && msg.Message.compression == NO_COMPRESSION_ID {
+					plain = append(plain, msg)
+					continue
+				}
+				flush()
+				if sizeErr := b.checkSize(topic, partition, msg.Message); sizeErr != nil {
+					tooLarge, err = append(tooLarge, msg), sizeErr
+				} else {
+					batch = append(batch, msg)
+				}
+			}
+			flush()
+			wire.add(topic, partition, batch)
+			rejected.add(topic, partition, tooLarge)
+		}
+	}
+	return wire, rejected, err
+}
+
+// Compress uncompressed messages of one topic/partition into a single wrapper message,
+// splitting them in half until each wrapper is under MaxMessageSize if SplitLargeBatches
+func (b *Broker) compressBatch(codec PayloadCodec, topic string, partition int,
+	msgs []*MessageTopic) ([]*MessageTopic, []*MessageTopic, error) {
+
+	plain := make([]*Message, len(msgs))
+	rawBytes := 0
+	for i, msg := range msgs {
+		plain[i] = msg.Message
+		rawBytes += int(msg.Message.TotalLen())
+	}
+	wrapper := NewCompressedMessagesWithCodec(codec, plain...)
+	err := b.checkSize(topic, partition, wrapper)
+	if err == nil {
+		if metrics, ok := b.Metrics.(CompressionMetrics); ok {
+			metrics.Compression(topic, rawBytes, int(wrapper.TotalLen()))
+		}
+		return []*MessageTopic{{Topic: topic, Partition: partition, Message: wrapper}}, nil, nil
+	}
+	if !b.SplitLargeBatches || len(msgs) < 2 {
+		return nil, msgs, err
+	}
+	half := len(msgs) / 2
+	first, firstRejected, firstErr := b.compressBatch(codec, topic, partition, msgs[:half])
+	second, secondRejected, secondErr := b.compressBatch(codec, topic, partition, msgs[half:])
+	if secondErr == nil {
+		secondErr = firstErr
+	}
+	return append(first, second...), append(firstRejected, secondRejected...), secondErr
+}
@@ -0,0 +1,439 @@
+/*
+ *  Copyright (c) 2011 NeuStar, Inc.
+ *  All rights reserved.
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  NeuStar, the Neustar logo and related names and logos are registered
+ *  trademarks, service marks or tradenames of NeuStar, Inc. All other
+ *  product names, company names, marks, logos and symbols may be trademarks
+ *  of their respective owners.
+ */
+
+package kafka
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Read a java style properties file:  key=value, key:value or key value per line,
+// # and ! start comments, and a trailing \ continues the value on the next line
+func ParseProperties(r io.Reader) (map[string]string, error) {
+	props := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	var pending string
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(pending) == 0 && (len(line) == 0 || line[0] == '#' || line[0] == '!') {
+			continue
+		}
+		if strings.HasSuffix(line, "\\") {
+			pending += strings.TrimSuffix(line, "\\")
+			continue
+		}
+		line, pending = pending+line, ""
+		idx := strings.IndexAny(line, "=: \t")
+		if idx < 0 {
+			props[line] = ""
+			continue
+		}
+		key := strings.TrimSpace(line[:idx])
+		value := strings.TrimSpace(line[idx+1:])
+		if len(value) > 0 && (value[0] == '=' || value[0] == ':') {
+			// key = value, the separator follows whitespace
+			value = strings.TrimSpace(value[1:])
+		}
+		props[key] = value
+	}
+	if len(pending) > 0 {
+		return nil, fmt.Errorf("properties end with a line continuation")
+	}
+	return props, scanner.Err()
+}
+
+func LoadProperties(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ParseProperties(file)
+}
+
+// sets each field from props if the key is present, keeping the first error
+type propertyReader struct {
+	props map[string]string
+	err   error
+}
+
+func (p *propertyReader) String(key string, field *string) {
+	if value, ok := p.props[key]; ok {
+		*field = value
+	}
+}
+
+func (p *propertyReader) Int(key string, field *int) {
+	value, ok := p.props[key]
+	if !ok || p.err != nil {
+		return
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		p.err = fmt.Errorf("invalid %s %q: not an integer", key, value)
+		return
+	}
+	*field = n
+}
+
+func (p *propertyReader) Bool(key string, field *bool) {
+	value, ok := p.props[key]
+	if !ok || p.err != nil {
+		return
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		p.err = fmt.Errorf("invalid %s %q: not a boolean", key, value)
+		return
+	}
+	*field = b
+}
+
+func (p *propertyReader) List(key string, field *[]string) {
+	value, ok := p.props[key]
+	if !ok {
+		return
+	}
+	list := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			list = append(list, item)
+		}
+	}
+	*field = list
+}
+
+// Parse a broker.list of brokerid:host:port, returning the host:port of each
+func ParseBrokerList(brokerList []string) ([]string, error) {
+	hosts := make([]string, 0, len(brokerList))
+	for _, broker := range brokerList {
+		parts := strings.SplitN(broker, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid broker.list entry %q, expected brokerid:host:port", broker)
+		}
+		if _, err := strconv.Atoi(parts[0]); err != nil {
+			return nil, fmt.Errorf("invalid broker id in broker.list entry %q", broker)
+		}
+		if _, _, err := net.SplitHostPort(parts[1]); err != nil {
+			return nil, fmt.Errorf("invalid broker.list entry %q: %v", broker, err)
+		}
+		hosts = append(hosts, parts[1])
+	}
+	return hosts, nil
+}
+
+// the first broker of a broker.list, which is the one the go client connects to
+func firstBroker(brokerList []string) (string, error) {
+	hosts, err := ParseBrokerList(brokerList)
+	if err != nil {
+		return "", err
+	}
+	if len(hosts) == 0 {
+		return "", fmt.Errorf("broker.list is required")
+	}
+	return hosts[0], nil
+}
+
+// ConsumerConfig holds the consumer.properties settings of the scala consumer the go
+// consumers use, with the same keys and defaults.  broker.list (brokerid:host:port, comma
+// delimited) isn't in the scala consumer config, NewConsumerWithConfig connects to the
+// first broker of it.  groupid, zk.* and autocommit.* are only used by the zookeeper
+// consumer in zkutils (NewConsumerWithConfig and AutoCommit), which finds the broker and
+// the groups committed offsets in zookeeper instead.  queuedchunks.max, backoff.increment.ms
+// and consumer.timeout.ms are only used by NewConsumerIterator
+type ConsumerConfig struct {
+	GroupId              string   // groupid
+	BrokerList           []string // broker.list
+	ZkConnect            string   // zk.connect
+	ZkSessionTimeoutMs   int      // zk.sessiontimeout.ms
+	SocketTimeoutMs      int      // socket.timeout.ms, connecting and for each fetch
+	SocketBufferSize     int      // socket.buffersize
+	FetchSize            int      // fetch.size
+	BackoffIncrementMs   int      // backoff.increment.ms
+	QueuedChunksMax      int      // queuedchunks.max
+	AutoCommit           bool     // autocommit.enable
+	AutoCommitIntervalMs int      // autocommit.interval.ms
+	AutoOffsetReset      string   // autooffset.reset, smallest or largest
+	ConsumerTimeoutMs    int      // consumer.timeout.ms, -1 waits forever
+}
+
+// A ConsumerConfig with the scala consumer defaults
+func DefaultConsumerConfig() *ConsumerConfig {
+	return &ConsumerConfig{
+		ZkSessionTimeoutMs:   6000,
+		SocketTimeoutMs:      30 * 1000,
+		SocketBufferSize:     64 * 1024,
+		FetchSize:            300 * 1024,
+		BackoffIncrementMs:   1000,
+		QueuedChunksMax:      10,
+		AutoCommit:           true,
+		AutoCommitIntervalMs: 10 * 1000,
+		AutoOffsetReset:      "smallest",
+		ConsumerTimeoutMs:    -1,
+	}
+}
+
+// Create a ConsumerConfig from properties, keys not present keep their default
+func NewConsumerConfig(props map[string]string) (*ConsumerConfig, error) {
+	c := DefaultConsumerConfig()
+	p := &propertyReader{props: props}
+	p.String("groupid", &c.GroupId)
+	p.List("broker.list", &c.BrokerList)
+	p.String("zk.connect", &c.ZkConnect)
+	p.Int("zk.sessiontimeout.ms", &c.ZkSessionTimeoutMs)
+	p.Int("socket.timeout.ms", &c.SocketTimeoutMs)
+	p.Int("socket.buffersize", &c.SocketBufferSize)
+	p.Int("fetch.size", &c.FetchSize)
+	p.Int("backoff.increment.ms", &c.BackoffIncrementMs)
+	p.Int("queuedchunks.max", &c.QueuedChunksMax)
+	p.Bool("autocommit.enable", &c.AutoCommit)
+	p.Int("autocommit.interval.ms", &c.AutoCommitIntervalMs)
+	p.String("autooffset.reset", &c.AutoOffsetReset)
+	p.Int("consumer.timeout.ms", &c.ConsumerTimeoutMs)
+	if p.err != nil {
+		return nil, p.err
+	}
+	return c, c.Validate()
+}
+
+func LoadConsumerConfig(path string) (*ConsumerConfig, error) {
+	props, err := LoadProperties(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewConsumerConfig(props)
+}
+
+func (c *ConsumerConfig) Validate() error {
+	if _, err := ParseBrokerList(c.BrokerList); err != nil {
+		return err
+	}
+	if c.SocketTimeoutMs < 0 {
+		return fmt.Errorf("socket.timeout.ms must be 0 or more, got %d", c.SocketTimeoutMs)
+	}
+	if c.FetchSize <= 0 {
+		return fmt.Errorf("fetch.size must be positive, got %d", c.FetchSize)
+	}
+	if c.QueuedChunksMax <= 0 {
+		return fmt.Errorf("queuedchunks.max must be positive, got %d", c.QueuedChunksMax)
+	}
+	if c.AutoCommitIntervalMs <= 0 {
+		return fmt.Errorf("autocommit.interval.ms must be positive, got %d", c.AutoCommitIntervalMs)
+	}
+	if c.AutoOffsetReset != "smallest" && c.AutoOffsetReset != "largest" {
+		return fmt.Errorf("autooffset.reset must be smallest or largest, got %q", c.AutoOffsetReset)
+	}
+	if c.ConsumerTimeoutMs < -1 {
+		return fmt.Errorf("consumer.timeout.ms must be -1 or more, got %d", c.ConsumerTimeoutMs)
+	}
+	return nil
+}
+
+// The offset time to start from when there is no committed offset, -2 for smallest
+// and -1 for largest
+func (c *ConsumerConfig) ResetOffsetTime() int64 {
+	if c.AutoOffsetReset == "largest" {
+		return -1
+	}
+	return -2
+}
+
+// Set the socket.timeout.ms and socket.buffersize of consumer
+func (c *ConsumerConfig) SetSocketOptions(consumer *BrokerConsumer) {
+	timeout := time.Duration(c.SocketTimeoutMs) * time.Millisecond
+	consumer.SetSocketOptions(timeout, timeout, c.SocketBufferSize)
+}
+
+// Create a consumer for partitions of topic on the first broker of config.BrokerList, starting
+// from the offset given by autooffset.reset and fetching fetch.size bytes at a time, with the
+// socket options of config.  The groups committed offsets are not read, see
+// zkutils.NewConsumerWithConfig for that
+func NewConsumerWithConfig(config *ConsumerConfig, topic string, partitions ...int) (*BrokerConsumer, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	hostname, err := firstBroker(config.BrokerList)
+	if err != nil {
+		return nil, fmt.Errorf("%v, or use zkutils.NewConsumerWithConfig to find the broker in zookeeper", err)
+	}
+	if len(partitions) == 0 {
+		partitions = []int{0}
+	}
+	tplist := make([]*TopicPartition, len(partitions))
+	for tpi, part := range partitions {
+		tp := &TopicPartition{Topic: topic, Partition: part, MaxSize: uint32(config.FetchSize)}
+		if tp.Offset, err = GetOffsetBefore(hostname, tp, config.ResetOffsetTime()); err != nil {
+			return nil, fmt.Errorf("could not get the %s offset of %s-%d: %v", config.AutoOffsetReset, topic, part, err)
+		}
+		tplist[tpi] = tp
+	}
+	consumer := NewMultiConsumer(hostname, tplist)
+	config.SetSocketOptions(consumer)
+	return consumer, nil
+}
+
+// ProducerConfig holds the producer.properties settings of the scala producer the go
+// producers use, with the same keys and defaults
+type ProducerConfig struct {
+	BrokerList       []string // broker.list
+	ProducerType     string   // producer.type, sync or async
+	CompressionCodec int      // compression.codec, 0 none or 1 gzip
+	CompressedTopics []string // compressed.topics, empty compresses all topics
+	QueueTimeMs      int      // queue.time, async only
+	BatchSize        int      // batch.size, async only
+	BufferSize       int      // buffer.size, the socket buffer
+	ConnectTimeoutMs int      // connect.timeout.ms
+	SocketTimeoutMs  int      // socket.timeout.ms
+	MaxMessageSize   int      // max.message.size
+}
+
+// A ProducerConfig with the scala producer defaults
+func DefaultProducerConfig() *ProducerConfig {
+	return &ProducerConfig{
+		ProducerType:     "sync",
+		CompressionCodec: NO_COMPRESSION_ID,
+		QueueTimeMs:      5000,
+		BatchSize:        200,
+		BufferSize:       100 * 1024,
+		ConnectTimeoutMs: 5000,
+		SocketTimeoutMs:  30000,
+		MaxMessageSize:   1000000,
+	}
+}
+
+// Create a ProducerConfig from properties, keys not present keep their default
+func NewProducerConfig(props map[string]string) (*ProducerConfig, error) {
+	c := DefaultProducerConfig()
+	p := &propertyReader{props: props}
+	p.List("broker.list", &c.BrokerList)
+	p.String("producer.type", &c.ProducerType)
+	p.Int("compression.codec", &c.CompressionCodec)
+	p.List("compressed.topics", &c.CompressedTopics)
+	p.Int("queue.time", &c.QueueTimeMs)
+	p.Int("batch.size", &c.BatchSize)
+	p.Int("buffer.size", &c.BufferSize)
+	p.Int("connect.timeout.ms", &c.ConnectTimeoutMs)
+	p.Int("socket.timeout.ms", &c.SocketTimeoutMs)
+	p.Int("max.message.size", &c.MaxMessageSize)
+	if p.err != nil {
+		return nil, p.err
+	}
+	return c, c.Validate()
+}
+
+func LoadProducerConfig(path string) (*ProducerConfig, error) {
+	props, err := LoadProperties(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewProducerConfig(props)
+}
+
+func (c *ProducerConfig) Validate() error {
+	if _, err := ParseBrokerList(c.BrokerList); err != nil {
+		return err
+	}
+	if c.ProducerType != "sync" && c.ProducerType != "async" {
+		return fmt.Errorf("producer.type must be sync or async, got %q", c.ProducerType)
+	}
+	if c.CompressionCodec != NO_COMPRESSION_ID && c.CompressionCodec != GZIP_COMPRESSION_ID {
+		return fmt.Errorf("unknown compression.codec %d", c.CompressionCodec)
+	}
+	if c.QueueTimeMs <= 0 {
+		return fmt.Errorf("queue.time must be positive, got %d", c.QueueTimeMs)
+	}
+	if c.BatchSize <= 0 {
+		return fmt.Errorf("batch.size must be positive, got %d", c.BatchSize)
+	}
+	if c.ConnectTimeoutMs < 0 || c.SocketTimeoutMs < 0 {
+		return fmt.Errorf("connect.timeout.ms and socket.timeout.ms must be 0 or more, got %d and %d",
+			c.ConnectTimeoutMs, c.SocketTimeoutMs)
+	}
+	if c.MaxMessageSize <= 0 {
+		return fmt.Errorf("max.message.size must be positive, got %d", c.MaxMessageSize)
+	}
+	return nil
+}
+
+// set the size limit, compression and socket options of the config on broker
+func (c *ProducerConfig) configure(broker *Broker) {
+	broker.Compression = c.CompressionPolicy()
+	broker.MaxMessageSize = c.MaxMessageSize
+	broker.ConnectTimeout = time.Duration(c.ConnectTimeoutMs) * time.Millisecond
+	broker.SocketTimeout = time.Duration(c.SocketTimeoutMs) * time.Millisecond
+	broker.SocketBufferSize = c.BufferSize
+}
+
+// The compression policy given by compression.codec and compressed.topics
+func (c *ProducerConfig) CompressionPolicy() CompressionPolicy {
+	return NewCompressionPolicy(DefaultCodecsMap[byte(c.CompressionCodec)], c.CompressedTopics...)
+}
+
+// Create a producer for partitions of topic (randomly partitioned if there is more
+// than one) on the first broker of config.BrokerList.  With producer.type async it
+// buffers batch.size messages for queue.time ms, Close sends the buffered messages
+func NewProducerWithConfig(config *ProducerConfig, topic string, partitions ...int) (*BrokerPublisher, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	hostname, err := firstBroker(config.BrokerList)
+	if err != nil {
+		return nil, err
+	}
+	if len(partitions) == 0 {
+		partitions = []int{0}
+	}
+	publisher := NewPartitionedProducer(hostname, topic, partitions)
+	config.configure(publisher.broker)
+	if config.ProducerType == "async" {
+		if err = publisher.SetAsync(int64(config.QueueTimeMs), config.BatchSize); err != nil {
+			return nil, err
+		}
+	}
+	return publisher, nil
+}
+
+// Create a buffered sender for partitions of topic on the first broker of config.BrokerList,
+// buffering up to batch.size messages for queue.time ms whatever the producer.type, for
+// sending MessageTopics rather than publishing Messages with NewProducerWithConfig
+func NewBufferedSenderWithConfig(config *ProducerConfig, topic string, partitions ...int) (MessageSender, *net.TCPConn, error) {
+	if err := config.Validate(); err != nil {
+		return nil, nil, err
+	}
+	hostname, err := firstBroker(config.BrokerList)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(partitions) == 0 {
+		partitions = []int{0}
+	}
+	broker := NewRandomPartitionedBroker(hostname, topic, partitions)
+	config.configure(broker)
+	return NewBufferedSender(broker, int64(config.QueueTimeMs), config.BatchSize)
+}
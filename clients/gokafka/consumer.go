@@ -24,8 +24,8 @@ package kafka
 
 import (
 	//"encoding/binary"
+	"errors"
 	"io"
-	"log"
 	"net"
 	"strings"
 	"time"
@@ -83,13 +83,125 @@ func (consumer *BrokerConsumer) AddCodecs(payloadCodecs []PayloadCodec) {
 	}
 }
 
+// Set the Metrics implementation that receives this consumers statistics, nil discards them
+func (consumer *BrokerConsumer) SetMetrics(metrics Metrics) {
+	if metrics == nil {
+		metrics = NoopMetrics{}
+	}
+	consumer.broker.Metrics = metrics
+}
+
+// Set the Logger for this consumer, the default discards all output
+func (consumer *BrokerConsumer) SetLogger(logger Logger) {
+	if logger == nil {
+		logger = NoopLogger{}
+	}
+	consumer.broker.Logger = logger
+}
+
+// Set the timeout connecting to the broker and for each fetch, and the socket buffer size.
+// 0 waits forever or keeps the system default
+func (consumer *BrokerConsumer) SetSocketOptions(connectTimeout, socketTimeout time.Duration, bufferSize int) {
+	consumer.broker.ConnectTimeout = connectTimeout
+	consumer.broker.SocketTimeout = socketTimeout
+	consumer.broker.SocketBufferSize = bufferSize
+}
+
+// Limit the rate messages and bytes are consumed at, fetches wait until they are under the limits
+func (consumer *BrokerConsumer) SetThrottle(throttle *Throttler) {
+	consumer.broker.Throttle = throttle
+}
+
+// Add interceptors that see each decoded message before the handler, after any already added
+func (consumer *BrokerConsumer) AddInterceptors(interceptors ...ConsumerInterceptor) {
+	consumer.broker.ConsumerInterceptors = append(consumer.broker.ConsumerInterceptors, interceptors...)
+}
+
+// Stop fetching a topic/partition, keeping its offset, until it is resumed
+func (consumer *BrokerConsumer) Pause(topic string, partition int) {
+	consumer.broker.mu.Lock()
+	defer consumer.broker.mu.Unlock()
+	if consumer.broker.paused == nil {
+		consumer.broker.paused = make(map[partitionKey]bool)
+	}
+	consumer.broker.paused[partitionKey{topic, partition}] = true
+}
+
+// Start fetching a paused topic/partition again, from where it was paused
+func (consumer *BrokerConsumer) Resume(topic string, partition int) {
+	consumer.broker.mu.Lock()
+	defer consumer.broker.mu.Unlock()
+	delete(consumer.broker.paused, partitionKey{topic, partition})
+}
+
+// leave a topic/partition out of fetches, or fetch it again, without changing whether
+// the caller paused it
+func (consumer *BrokerConsumer) hold(topic string, partition int, held bool) {
+	consumer.broker.mu.Lock()
+	defer consumer.broker.mu.Unlock()
+	if consumer.broker.held == nil {
+		consumer.broker.held = make(map[partitionKey]bool)
+	}
+	if held {
+		consumer.broker.held[partitionKey{topic, partition}] = true
+	} else {
+		delete(consumer.broker.held, partitionKey{topic, partition})
+	}
+}
+
+// Is the topic/partition paused
+func (consumer *BrokerConsumer) Paused(topic string, partition int) bool {
+	consumer.broker.mu.Lock()
+	defer consumer.broker.mu.Unlock()
+	return consumer.broker.paused[partitionKey{topic, partition}]
+}
+
+// Add topic/partitions to consume, from their Offset.  Topic/partitions already
+// being consumed are left as they are
+func (consumer *BrokerConsumer) Assign(tplist ...*TopicPartition) {
+	consumer.broker.mu.Lock()
+	defer consumer.broker.mu.Unlock()
+	// copy, so fetches in progress keep the list they started with
+	topics := append(make([]*TopicPartition, 0, len(consumer.broker.topics)+len(tplist)), consumer.broker.topics...)
+	for _, tp := range tplist {
+		if consumer.broker.assigned(tp.Topic, tp.Partition) == nil {
+			topics = append(topics, tp)
+		}
+	}
+	consumer.broker.topics = topics
+}
+
+// Stop consuming a topic/partition, returns a copy of it with the offset consumed up to,
+// or nil if it was not being consumed.  The last topic/partition can't be unassigned
+func (consumer *BrokerConsumer) Unassign(topic string, partition int) *TopicPartition {
+	consumer.broker.mu.Lock()
+	defer consumer.broker.mu.Unlock()
+	tp := consumer.broker.assigned(topic, partition)
+	if tp == nil || len(consumer.broker.topics) == 1 {
+		return nil
+	}
+	topics := make([]*TopicPartition, 0, len(consumer.broker.topics)-1)
+	for _, other := range consumer.broker.topics {
+		if other != tp {
+			topics = append(topics, other)
+		}
+	}
+	consumer.broker.topics = topics
+	delete(consumer.broker.paused, partitionKey{topic, partition})
+	delete(consumer.broker.held, partitionKey{topic, partition})
+	// a copy, a fetch in progress may still move the offset of tp
+	unassigned := *tp
+	return &unassigned
+}
+
 func (consumer *BrokerConsumer) handleConnError(err error, conn *net.TCPConn) error {
 	errs := err.Error()
 	if strings.HasSuffix(errs, "broken pipe") {
 		for i := 0; i < 100; i++ {
-			log.Println("Reconnecting")
+			consumer.broker.Logger.Warn("reconnecting", "host", consumer.broker.hostname, "attempt", i)
 			conn, err = consumer.broker.connect()
 			if err == nil {
+				consumer.broker.Metrics.Reconnect(consumer.broker.hostname)
 				return nil
 			}
 			time.Sleep(time.Millisecond * 1000)
@@ -98,6 +210,20 @@ func (consumer *BrokerConsumer) handleConnError(err error, conn *net.TCPConn) er
 	return err
 }
 func (consumer *BrokerConsumer) ConsumeOnChannel(msgChan chan *Message, pollTimeoutMs int64, quit chan bool) (int, error) {
+	return consumer.consumeOnChannel(func(mm *MessageAndMetadata) {
+		msgChan <- mm.Message
+	}, func() { close(msgChan) }, pollTimeoutMs, quit)
+}
+
+// Like ConsumeOnChannel, but each message carries its topic, partition and offsets, so
+// multi topic/partition consumers can tell messages apart and commit their position
+func (consumer *BrokerConsumer) ConsumeMetadataOnChannel(msgChan chan *MessageAndMetadata, pollTimeoutMs int64, quit chan bool) (int, error) {
+	return consumer.consumeOnChannel(func(mm *MessageAndMetadata) {
+		msgChan <- mm
+	}, func() { close(msgChan) }, pollTimeoutMs, quit)
+}
+
+func (consumer *BrokerConsumer) consumeOnChannel(send func(*MessageAndMetadata), closeChan func(), pollTimeoutMs int64, quit chan bool) (int, error) {
 	conn, err := consumer.broker.connect()
 	time.Sleep(time.Duration(pollTimeoutMs) * time.Millisecond * 2)
 	if err != nil {
@@ -121,8 +247,8 @@ func (consumer *BrokerConsumer) ConsumeOnChannel(msgChan chan *Message, pollTime
 			// TODO:  This Poll Timeout is pretty flawed, as the actual consume could take more than x
 			//         IT should take ts = time.Now() before consume, then after check delta
 			//log.Println("about to poll for consume ", pollTimeoutMs)
-			_, err := consumer.consumeWithConn(conn, func(topic string, partition int, msg *Message) {
-				msgChan <- msg
+			_, err := consumer.fetchWithConn(conn, func(mm *MessageAndMetadata) {
+				send(mm)
 				num += 1
 				pollMsgs += 1
 				errCt = 0
@@ -134,11 +260,15 @@ func (consumer *BrokerConsumer) ConsumeOnChannel(msgChan chan *Message, pollTime
 					time.Sleep(time.Duration(pollTimeoutMs+int64(15)) * time.Millisecond)
 					// lets try reconnecting?
 					conn, err = consumer.broker.connect()
-					log.Println("Connection Error? ", errCt, " ", err, " fixed? ")
+					if err == nil {
+						consumer.broker.Metrics.Reconnect(consumer.broker.hostname)
+					}
+					consumer.broker.Logger.Warn("connection error, reconnected", "host", consumer.broker.hostname,
+						"errors", errCt, "err", err)
 					//quit <- true // force quit
 				} else {
 					// expected error, EOF is no data from kafka server?
-					log.Println("EOF? Error: ", errCt, " ", err)
+					consumer.broker.Logger.Debug("EOF reading from broker", "host", consumer.broker.hostname, "errors", errCt)
 				}
 			}
 			if errCt > 50 {
@@ -162,9 +292,9 @@ func (consumer *BrokerConsumer) ConsumeOnChannel(msgChan chan *Message, pollTime
 	// wait to be told to stop..
 	<-quit
 	isDone = true
-	log.Println("got quit signal, clossing conn")
+	consumer.broker.Logger.Info("got quit signal, closing conn", "host", consumer.broker.hostname)
 	conn.Close()
-	close(msgChan)
+	closeChan()
 	done <- true
 	return num, err
 }
@@ -179,7 +309,30 @@ func (consumer *BrokerConsumer) Consume(handlerFunc MessageHandlerFunc) (int, er
 	num, err := consumer.consumeWithConn(conn, handlerFunc)
 
 	if err != nil {
-		log.Println("Fatal Error: ", err)
+		consumer.broker.Logger.Error("consume failed", "host", consumer.broker.hostname, "err", err)
+	}
+
+	return num, err
+}
+
+// Consume a message set for each topic/partition, calling handler with each message and
+// its offsets.  NextOffset is the position to commit once a message is handled
+func (consumer *BrokerConsumer) ConsumeMetadata(handler func(*MessageAndMetadata)) (int, error) {
+	return consumer.fetch(handler)
+}
+
+// Like Consume, with the offsets of each message
+func (consumer *BrokerConsumer) fetch(handler func(*MessageAndMetadata)) (int, error) {
+	conn, err := consumer.broker.connect()
+	if err != nil {
+		return -1, err
+	}
+	defer conn.Close()
+
+	num, err := consumer.fetchWithConn(conn, handler)
+
+	if err != nil && err != io.EOF {
+		consumer.broker.Logger.Error("consume failed", "host", consumer.broker.hostname, "err", err)
 	}
 
 	return num, err
@@ -189,8 +342,10 @@ func (consumer *BrokerConsumer) tryConnect(conn *net.TCPConn, tp *TopicPartition
 	var errCode int
 	request := consumer.broker.EncodeConsumeRequest()
 	//log.Println("offset=", tp.Offset, " ", tp.MaxSize, " ", request, " ", tp.Topic, " ", tp.Partition, "  \n\t", string(request))
+	start := time.Now()
 	_, err = conn.Write(request)
 	if err != nil {
+		consumer.broker.Metrics.RequestError(REQUEST_FETCH, err)
 		if err = consumer.handleConnError(err, conn); err != nil {
 			return err, nil
 		}
@@ -198,14 +353,21 @@ func (consumer *BrokerConsumer) tryConnect(conn *net.TCPConn, tp *TopicPartition
 
 	reader = consumer.broker.readResponse(conn)
 	err, errCode = reader.ReadHeader()
+	if err != nil {
+		consumer.broker.Metrics.RequestError(REQUEST_FETCH, err)
+	} else {
+		consumer.broker.Metrics.RequestLatency(REQUEST_FETCH, time.Since(start))
+	}
 	if err != nil && errCode == 1 {
-		log.Println("Bad Offset id, resetting?")
+		consumer.broker.Logger.Warn("bad offset id, resetting", "topic", tp.Topic, "partition", tp.Partition,
+			"offset", tp.Offset)
 		// Error Code 1 means bad offsetid, we shold get a good offset, and reconnect!
-		offsetVal := GetOffset(consumer.broker.hostname, tp)
+		offsetVal := consumer.partitionOffset(-2, tp)
 		if offsetVal > 0 {
 			// RECONNECT!
-			log.Println("RECONNECTING !!! ", offsetVal)
-			tp.Offset = offsetVal
+			consumer.broker.Logger.Info("reconnecting at earliest offset", "topic", tp.Topic, "partition", tp.Partition,
+				"offset", offsetVal)
+			consumer.broker.setOffset(tp, offsetVal)
 			if err, reader = consumer.tryConnect(conn, tp); err != nil {
 				return err, nil
 			}
@@ -221,20 +383,39 @@ func (consumer *BrokerConsumer) tryConnect(conn *net.TCPConn, tp *TopicPartition
 }
 
 func (consumer *BrokerConsumer) consumeWithConn(conn *net.TCPConn, handlerFunc MessageHandlerFunc) (num int, err error) {
+	return consumer.fetchWithConn(conn, func(mm *MessageAndMetadata) {
+		handlerFunc(mm.Topic, mm.Partition, mm.Message)
+	})
+}
+
+// fetch and decode a message set for each topic/partition, calling handler for each message
+func (consumer *BrokerConsumer) fetchWithConn(conn *net.TCPConn, handler func(*MessageAndMetadata)) (num int, err error) {
 
 	var msgs []*Message
 	var payloadConsumed int
 	var reader *ByteBuffer
 
-	if len(consumer.broker.topics) > 1 {
-		return consumer.consumeMultiWithConn(conn, handlerFunc)
+	if len(consumer.broker.assignedTopics()) > 1 {
+		return consumer.fetchMultiWithConn(conn, handler)
 	}
 
-	tp := consumer.broker.topics[0]
+	tplist := consumer.broker.fetchTopics()
+	if len(tplist) == 0 {
+		return 0, nil
+	}
+	tp := tplist[0]
 	if err, reader = consumer.tryConnect(conn, tp); err != nil {
 		return -1, err
 	}
 
+	var bytesIn uint64
+	defer func() {
+		if num > 0 {
+			consumer.broker.Metrics.MessagesIn(tp.Topic, tp.Partition, num, int(bytesIn))
+			consumer.broker.Throttle.Wait(num, int(bytesIn))
+		}
+	}()
+
 	//log.Println(reader.)
 	if reader.Size > 2 {
 		// parse out the messages
@@ -244,17 +425,19 @@ func (consumer *BrokerConsumer) consumeWithConn(conn *net.TCPConn, handlerFunc M
 			payloadConsumed, msgs, err = reader.NextMsg(consumer.codecs)
 			//log.Println("after nxt msg", len(msgs), " ", payloadConsumed, " ", currentOffset)
 			if err != nil {
-				log.Println("ERROR< ", err)
+				consumer.broker.Logger.Error("could not read message", "topic", tp.Topic, "partition", tp.Partition,
+					"offset", tp.Offset+currentOffset, "err", err)
 			}
 			if msgs == nil || len(msgs) == 0 {
 				// this isn't invalid as net conn bytes might contain partial messages 
-				tp.Offset += currentOffset
+				consumer.broker.setOffset(tp, tp.Offset+currentOffset)
 				//log.Println("end of message set ", tp.Offset, " ", currentOffset)
 				return num, err
 			}
 			msgOffset := tp.Offset + currentOffset
+			setOffset := msgOffset
 
-			for _, msg := range msgs {
+			for i, msg := range msgs {
 				// update all of the messages offset
 				// multiple messages can be at the same offset (compressed for example)
 				msg.offset = msgOffset
@@ -262,41 +445,53 @@ func (consumer *BrokerConsumer) consumeWithConn(conn *net.TCPConn, handlerFunc M
 				msgOffset += msg.TotalLen()
 				//log.Println("end of message set ", msgOffset)
 				//log.Println("about to call handler func ", msgOffset)
-				handlerFunc(tp.Topic, tp.Partition, msg)
+				mm := newMessageAndMetadata(tp, msg, setOffset, uint64(payloadConsumed), i == len(msgs)-1)
+				if mm = consumer.broker.interceptConsume(mm); mm != nil {
+					handler(mm)
+				}
 				//log.Println("after handler func")
 				num += 1
 			}
+			bytesIn += uint64(payloadConsumed)
 
 			currentOffset += uint64(payloadConsumed)
 		}
 		// update the topic/partition segment offset for next consumption
-		tp.Offset += currentOffset
+		consumer.broker.setOffset(tp, tp.Offset+currentOffset)
 	}
 
 	return num, err
 }
 
-func (consumer *BrokerConsumer) consumeMultiWithConn(conn *net.TCPConn, handlerFunc MessageHandlerFunc) (num int, err error) {
+func (consumer *BrokerConsumer) fetchMultiWithConn(conn *net.TCPConn, handler func(*MessageAndMetadata)) (num int, err error) {
 
 	var errCode int
-	_, err = conn.Write(consumer.broker.EncodeConsumeRequestMultiFetch())
+	tplist := consumer.broker.fetchTopics()
+	if len(tplist) == 0 {
+		return 0, nil
+	}
+	start := time.Now()
+	_, err = conn.Write(consumer.broker.encodeMultiFetch(tplist))
 
 	if err != nil {
+		consumer.broker.Metrics.RequestError(REQUEST_MULTIFETCH, err)
 		if err = consumer.handleConnError(err, conn); err != nil {
 			return -1, err
 		}
 	}
-	log.Println("about to call read multi response")
-	reader := consumer.broker.readMultiResponse(conn)
-	log.Println("after call")
+	reader := consumer.broker.readMultiResponse(conn, len(tplist))
 	err, errCode = reader.ReadHeader()
-	log.Println("after read header", err)
+	if err != nil {
+		consumer.broker.Metrics.RequestError(REQUEST_MULTIFETCH, err)
+	} else {
+		consumer.broker.Metrics.RequestLatency(REQUEST_MULTIFETCH, time.Since(start))
+	}
 	if err != nil && errCode == 1 {
 		// RECONNECT!
-		log.Println("ERROR, bad offsetIds")
+		consumer.broker.Logger.Error("bad offset ids", "host", consumer.broker.hostname, "err", err)
 		return -1, err
 	} else if err != nil {
-		log.Println("Fatal Error: ", err)
+		consumer.broker.Logger.Error("multifetch failed", "host", consumer.broker.hostname, "err", err)
 		return -1, err
 	}
 
@@ -304,94 +499,137 @@ func (consumer *BrokerConsumer) consumeMultiWithConn(conn *net.TCPConn, handlerF
 	var currentOffset uint64
 	var msgs []*Message
 	var payloadConsumed int
+	var tpNum int
+	var bytesIn int
+
+	// report the messages and bytes read for the current topic/partition
+	reportIn := func() {
+		if tpNum > 0 {
+			consumer.broker.Metrics.MessagesIn(tp.Topic, tp.Partition, tpNum, int(currentOffset))
+			bytesIn += int(currentOffset)
+		}
+	}
+	defer func() {
+		if num > 0 {
+			consumer.broker.Throttle.Wait(num, bytesIn)
+		}
+	}()
 
-	log.Println("len ", reader.Len())
 	for tpi := 0; tpi < reader.Len(); tpi++ {
 		//log.Println("new loop ", tpi)
 		// do we not know the topic/partition?  or assume it stayed ordered?
-		tp = consumer.broker.topics[tpi]
+		tp = tplist[tpi]
 
 		length, err := reader.ReadSet()
-		log.Println("size of this set", length)
+		var respErr *BrokerResponseError
+		if errors.As(err, &respErr) && respErr.Code == 1 {
+			// bad offset id, like the single fetch continue from the earliest offset, the
+			// error set holds no messages so the other sets can still be read
+			earliest, oerr := GetOffsetBefore(consumer.broker.hostname, tp, -2)
+			if oerr != nil {
+				consumer.broker.Logger.Error("could not get the earliest offset", "topic", tp.Topic,
+					"partition", tp.Partition, "offset", tp.Offset, "err", oerr)
+				continue
+			}
+			consumer.broker.Logger.Warn("bad offset id, resetting to earliest offset", "topic", tp.Topic,
+				"partition", tp.Partition, "offset", tp.Offset, "earliest", earliest)
+			consumer.broker.setOffset(tp, earliest)
+			continue
+		}
 		if err != nil || reader == nil {
-			log.Println("ERROR, err in read", err)
+			consumer.broker.Logger.Error("could not read message set", "topic", tp.Topic, "partition", tp.Partition,
+				"offset", tp.Offset, "err", err)
 			return -1, err
 		}
+		consumer.broker.Logger.Debug("message set", "topic", tp.Topic, "partition", tp.Partition,
+			"offset", tp.Offset, "size", length)
 		currentOffset = 0
+		tpNum = 0
 	msgsetloop:
 		for {
 			payloadConsumed, msgs, err = reader.NextMsg(consumer.codecs)
-			log.Println("consumed", payloadConsumed, currentOffset)
 			if err != nil {
-				log.Println("ERROR< ", err)
+				consumer.broker.Logger.Error("could not read message", "topic", tp.Topic, "partition", tp.Partition,
+					"offset", tp.Offset+currentOffset, "err", err)
 				break
 			}
 			if msgs == nil || len(msgs) == 0 {
 				// this isn't invalid as large messages might contain partial messages 
-				tp.Offset += currentOffset
-				log.Println("no messages? ")
+				consumer.broker.setOffset(tp, tp.Offset+currentOffset)
+				consumer.broker.Logger.Debug("no complete messages", "topic", tp.Topic, "partition", tp.Partition,
+					"offset", tp.Offset)
+				reportIn()
 				return num, err
 			}
 			msgOffset := tp.Offset + currentOffset
+			setOffset := msgOffset
 
-			for _, msg := range msgs {
+			for i, msg := range msgs {
 				// update all of the messages offset
 				// multiple messages can be at the same offset (compressed for example)
 				msg.offset = msgOffset
 				//msgOffset += 4 + uint64(msg.totalLength)
 				msgOffset += msg.TotalLen()
-				handlerFunc(tp.Topic, tp.Partition, msg)
+				mm := newMessageAndMetadata(tp, msg, setOffset, uint64(payloadConsumed), i == len(msgs)-1)
+				if mm = consumer.broker.interceptConsume(mm); mm != nil {
+					handler(mm)
+				}
 				num += 1
+				tpNum += 1
 			}
 
 			currentOffset += uint64(payloadConsumed)
-			log.Println(currentOffset, length)
 			if currentOffset+2 >= uint64(length) {
 				break msgsetloop
 			}
 		}
+		reportIn()
 		// update the topic/partition segment offset for next consumption
 		if currentOffset > 2 {
 			//currentOffset +=2
-			tp.Offset += currentOffset
+			consumer.broker.setOffset(tp, tp.Offset+currentOffset)
 		}
 
-		log.Println("tp.offset ", tp.Offset, tp.Partition)
+		consumer.broker.Logger.Debug("consumed message set", "topic", tp.Topic, "partition", tp.Partition,
+			"offset", tp.Offset, "messages", tpNum)
 	}
 	return num, err
 }
 
 // Get a list of valid offsets (up to maxNumOffsets) before the given time, where 
-// time is in milliseconds (-1, from the latest offset available, -2 from the smallest offset available)
+// offsetTime is in milliseconds (-1, from the latest offset available, -2 from the smallest offset available)
 // The result is a list of offsets, in descending order.
-func (consumer *BrokerConsumer) GetOffsets(time int64, maxNumOffsets uint32) ([]uint64, error) {
+func (consumer *BrokerConsumer) GetOffsets(offsetTime int64, maxNumOffsets uint32) ([]uint64, error) {
 	offsets := make([]uint64, 0)
 
 	conn, err := consumer.broker.connect()
 	if err != nil {
-		log.Println("ERROR ", err)
 		return offsets, err
 	}
 
 	defer conn.Close()
 
-	offsetRequest := consumer.broker.EncodeOffsetRequest(time, maxNumOffsets)
+	offsetRequest := consumer.broker.EncodeOffsetRequest(offsetTime, maxNumOffsets)
+	start := time.Now()
 	_, err = conn.Write(offsetRequest)
 	if err != nil {
-		log.Println("ERROR ", err)
+		consumer.broker.Logger.Error("offset request failed", "host", consumer.broker.hostname, "err", err)
+		consumer.broker.Metrics.RequestError(REQUEST_OFFSETS, err)
 		return offsets, err
 	}
 
 	reader := consumer.broker.readResponse(conn)
 	err, _ = reader.ReadHeader()
 	if err != nil {
-		log.Println("HEADER ERROR ", err)
+		consumer.broker.Logger.Error("offset response error", "host", consumer.broker.hostname, "err", err)
+		consumer.broker.Metrics.RequestError(REQUEST_OFFSETS, err)
 		return offsets, err
 	}
+	consumer.broker.Metrics.RequestLatency(REQUEST_OFFSETS, time.Since(start))
 	offsets, err = reader.Offsets()
 	//log.Println(time, " offsets Ct= ", len(offsets), " size=", reader.Size, " offsets =", offsets, " ", err)
 	if err != nil {
-		log.Println("ERROR ", err)
+		consumer.broker.Logger.Error("could not read offsets", "host", consumer.broker.hostname, "err", err)
 		return offsets, err
 	}
 
@@ -408,13 +646,39 @@ func GetMaxOffset(hostname string, tp *TopicPartition) uint64 {
 	return getOffset(hostname, -1, tp)
 }
 
+// Get the offset of the last segment before offsetTime (in milliseconds, -1 for the latest
+// offset, -2 for the earliest) for given host, TopicPartition.  Unlike GetOffset and
+// GetMaxOffset the error is returned rather than logged and returned as offset 0
+func GetOffsetBefore(hostname string, tp *TopicPartition, offsetTime int64) (uint64, error) {
+	broker := NewBrokerOffsetConsumer(hostname, tp.Topic, tp.Partition)
+	offsets, err := broker.GetOffsets(offsetTime, uint32(1))
+	if err != nil || len(offsets) == 0 {
+		return 0, err
+	}
+	return offsets[0], nil
+}
+
 // Get an offset for given host, TopicPartition
 func getOffset(hostname string, offsetTime int64, tp *TopicPartition) uint64 {
 	broker := NewBrokerOffsetConsumer(hostname, tp.Topic, tp.Partition)
 	//log.Printf("h=%s t=%s Partition=%d \n", hostname, tp.Topic, tp.Partition)
-	offsets, err := broker.GetOffsets(offsetTime, uint32(1))
+	return broker.firstOffset(offsetTime)
+}
+
+// Get an offset for one of this consumers TopicPartitions, sharing its Logger and Metrics
+func (consumer *BrokerConsumer) partitionOffset(offsetTime int64, tp *TopicPartition) uint64 {
+	broker := NewBrokerOffsetConsumer(consumer.broker.hostname, tp.Topic, tp.Partition)
+	broker.broker.Logger = consumer.broker.Logger
+	broker.broker.Metrics = consumer.broker.Metrics
+	return broker.firstOffset(offsetTime)
+}
+
+func (consumer *BrokerConsumer) firstOffset(offsetTime int64) uint64 {
+	offsets, err := consumer.GetOffsets(offsetTime, uint32(1))
 	if err != nil {
-		log.Println("Error: ", err)
+		tp := consumer.broker.assignedTopics()[0]
+		consumer.broker.Logger.Error("could not get offset", "topic", tp.Topic, "partition", tp.Partition,
+			"time", offsetTime, "err", err)
 	}
 	if len(offsets) == 1 {
 		return offsets[0]
@@ -424,3 +688,29 @@ func getOffset(hostname string, offsetTime int64, tp *TopicPartition) uint64 {
 	}
 	return 0
 }
+
+// The lag of a topic/partition, in bytes as offsets are byte positions in the log
+type PartitionLag struct {
+	Topic     string
+	Partition int
+	Offset    uint64
+	MaxOffset uint64
+	Lag       uint64
+}
+
+// Compare the current offset of each topic/partition being consumed against the
+// latest offset on the broker, and report the lag to Metrics
+func (consumer *BrokerConsumer) Lag() []PartitionLag {
+	topics := consumer.broker.assignedTopics()
+	lags := make([]PartitionLag, 0, len(topics))
+	for _, tp := range topics {
+		pl := PartitionLag{Topic: tp.Topic, Partition: tp.Partition, Offset: consumer.broker.offset(tp)}
+		pl.MaxOffset = consumer.partitionOffset(-1, tp)
+		if pl.MaxOffset > pl.Offset {
+			pl.Lag = pl.MaxOffset - pl.Offset
+		}
+		consumer.broker.Metrics.ConsumerLag(tp.Topic, tp.Partition, pl.Lag)
+		lags = append(lags, pl)
+	}
+	return lags
+}
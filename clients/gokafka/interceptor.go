@@ -0,0 +1,70 @@
+/*
+ *  Copyright (c) 2011 NeuStar, Inc.
+ *  All rights reserved.
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  NeuStar, the Neustar logo and related names and logos are registered
+ *  trademarks, service marks or tradenames of NeuStar, Inc. All other
+ *  product names, company names, marks, logos and symbols may be trademarks
+ *  of their respective owners.
+ */
+
+package kafka
+
+// ProducerInterceptor hooks the send path of the buffered sender, for auditing,
+// tracing or scrubbing messages in one place
+type ProducerInterceptor interface {
+	// Called with each message before it is buffered and encoded, returns the message
+	// to send, which may be msg, a modified msg or nil to drop it
+	OnSend(msg *MessageTopic) *MessageTopic
+	// Called with the messages of each produce request once it is written, or failed
+	// to be written (err is not nil)
+	OnAcknowledgement(msgs []*MessageTopic, err error)
+}
+
+// ConsumerInterceptor hooks the consumers handler dispatch
+type ConsumerInterceptor interface {
+	// Called with each decoded message before the handler, returns the message to
+	// handle, which may be mm, a modified mm or nil to skip it
+	OnConsume(mm *MessageAndMetadata) *MessageAndMetadata
+}
+
+// run the producer interceptors in the order they were added
+func (b *Broker) interceptSend(msg *MessageTopic) *MessageTopic {
+	for _, interceptor := range b.ProducerInterceptors {
+		if msg = interceptor.OnSend(msg); msg == nil {
+			return nil
+		}
+	}
+	return msg
+}
+
+func (b *Broker) acknowledge(msgs []*MessageTopic, err error) {
+	if len(msgs) == 0 {
+		return
+	}
+	for _, interceptor := range b.ProducerInterceptors {
+		interceptor.OnAcknowledgement(msgs, err)
+	}
+}
+
+// run the consumer interceptors in the order they were added
+func (b *Broker) interceptConsume(mm *MessageAndMetadata) *MessageAndMetadata {
+	for _, interceptor := range b.ConsumerInterceptors {
+		if mm = interceptor.OnConsume(mm); mm == nil {
+			return nil
+		}
+	}
+	return mm
+}
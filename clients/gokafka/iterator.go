@@ -0,0 +1,180 @@
+/*
+ *  Copyright (c) 2011 NeuStar, Inc.
+ *  All rights reserved.
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  NeuStar, the Neustar logo and related names and logos are registered
+ *  trademarks, service marks or tradenames of NeuStar, Inc. All other
+ *  product names, company names, marks, logos and symbols may be trademarks
+ *  of their respective owners.
+ */
+
+package kafka
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// returned by ConsumerIterator.Next when no message arrives within the consumer timeout
+var ErrConsumerTimeout = errors.New("kafka: consumer timeout, no message available")
+
+// returned by ConsumerIterator.Next after Close
+var ErrIteratorClosed = errors.New("kafka: consumer iterator closed")
+
+// A message with the topic/partition it came from and its position in the log
+type MessageAndMetadata struct {
+	Topic     string
+	Partition int
+	// offset of the message in the log, messages inside a compressed message
+	// all have the offset of the compressed message
+	Offset uint64
+	// offset to consume from to continue after this message, for all but the last
+	// message inside a compressed message this is the offset of the compressed message
+	NextOffset uint64
+	Message    *Message
+}
+
+func newMessageAndMetadata(tp *TopicPartition, msg *Message, setOffset, setSize uint64, last bool) *MessageAndMetadata {
+	mm := &MessageAndMetadata{Topic: tp.Topic, Partition: tp.Partition, Offset: setOffset, NextOffset: setOffset,
+		Message: msg}
+	if last {
+		mm.NextOffset = setOffset + setSize
+	}
+	return mm
+}
+
+// The codec the message was sent with
+func (mm *MessageAndMetadata) Codec() byte {
+	return mm.Message.Codec()
+}
+
+// The (decompressed) payload of the message
+func (mm *MessageAndMetadata) Payload() []byte {
+	return mm.Message.Payload()
+}
+
+// The position to commit once this message is processed, consuming from it resumes
+// after this message (or replays the rest of a compressed message set)
+func (mm *MessageAndMetadata) Position() *TopicPartition {
+	return &TopicPartition{Topic: mm.Topic, Partition: mm.Partition, Offset: mm.NextOffset}
+}
+
+// ConsumerIterator is a pull style consumer, like the scala ConsumerIterator.  A goroutine
+// fetches from the broker into a queue of up to queuedChunks fetched message sets, which
+// Next reads from.  The consumer must not be used directly while the iterator is open
+type ConsumerIterator struct {
+	consumer *BrokerConsumer
+	timeout  time.Duration
+	backoff  time.Duration
+	chunks   chan []*MessageAndMetadata
+	current  []*MessageAndMetadata
+	quit     chan bool
+	done     chan bool
+}
+
+// Create an iterator over the consumers topic/partitions.  queuedChunks is how many
+// fetched message sets are queued ahead of Next, timeout is how long Next waits for a
+// message before returning ErrConsumerTimeout (negative waits forever), and backoff is
+// how long to wait between fetches that return no messages
+func (consumer *BrokerConsumer) Iterator(queuedChunks int, timeout, backoff time.Duration) *ConsumerIterator {
+	if queuedChunks < 1 {
+		queuedChunks = 1
+	}
+	it := &ConsumerIterator{
+		consumer: consumer,
+		timeout:  timeout,
+		backoff:  backoff,
+		chunks:   make(chan []*MessageAndMetadata, queuedChunks),
+		quit:     make(chan bool),
+		done:     make(chan bool),
+	}
+	go it.fetchLoop()
+	return it
+}
+
+// Create an iterator with the fetch.size, autooffset.reset, queuedchunks.max,
+// consumer.timeout.ms and backoff.increment.ms of config
+func NewConsumerIterator(config *ConsumerConfig, topic string, partitions ...int) (*ConsumerIterator, error) {
+	consumer, err := NewConsumerWithConfig(config, topic, partitions...)
+	if err != nil {
+		return nil, err
+	}
+	return consumer.Iterator(config.QueuedChunksMax, time.Duration(config.ConsumerTimeoutMs)*time.Millisecond,
+		time.Duration(config.BackoffIncrementMs)*time.Millisecond), nil
+}
+
+func (it *ConsumerIterator) fetchLoop() {
+	defer close(it.done)
+	for {
+		chunk := make([]*MessageAndMetadata, 0)
+		num, err := it.consumer.fetch(func(mm *MessageAndMetadata) {
+			chunk = append(chunk, mm)
+		})
+		if len(chunk) > 0 {
+			select {
+			case it.chunks <- chunk:
+			case <-it.quit:
+				return
+			}
+		}
+		if num > 0 && (err == nil || err == io.EOF) {
+			continue
+		}
+		select {
+		case <-time.After(it.backoff):
+		case <-it.quit:
+			return
+		}
+	}
+}
+
+// Get the next message, waiting up to the consumer timeout (ErrConsumerTimeout) or
+// until ctx is done (ctx.Err())
+func (it *ConsumerIterator) Next(ctx context.Context) (*MessageAndMetadata, error) {
+	if len(it.current) == 0 {
+		var timeout <-chan time.Time
+		if it.timeout >= 0 {
+			timer := time.NewTimer(it.timeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case chunk := <-it.chunks:
+			it.current = chunk
+		case <-it.quit:
+			return nil, ErrIteratorClosed
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timeout:
+			return nil, ErrConsumerTimeout
+		}
+	}
+	mm := it.current[0]
+	it.current = it.current[1:]
+	return mm, nil
+}
+
+// Stop fetching, messages already queued are discarded
+func (it *ConsumerIterator) Close() {
+	select {
+	case <-it.quit:
+		return
+	default:
+	}
+	close(it.quit)
+	<-it.done
+}
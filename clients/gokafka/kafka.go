@@ -24,11 +24,11 @@ package kafka
 
 import (
 	"bufio"
-	"log"
 	"math/rand"
 	"net"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -61,11 +61,37 @@ type Broker struct {
 	topics      []*TopicPartition
 	hostname    string
 	Partitioner Partitioner
+	Metrics     Metrics
+	Logger      Logger
+	// limits the messages/bytes per second published or consumed, nil is unlimited
+	Throttle *Throttler
+	// called with messages the buffered sender failed to send, nil drops them
+	SendErrorHandler SendErrorHandler
+	// compresses the buffered senders batches per topic, nil sends them uncompressed
+	Compression CompressionPolicy
+	// max payload size of a message or compressed batch, 0 is unlimited
+	MaxMessageSize int
+	// split compressed batches over MaxMessageSize instead of rejecting them
+	SplitLargeBatches bool
+	// timeout connecting, and for each request once connected, 0 waits forever
+	ConnectTimeout time.Duration
+	SocketTimeout  time.Duration
+	// socket send and receive buffer size, 0 keeps the system default
+	SocketBufferSize int
+	// see the messages of the buffered sender and the consumer, in order
+	ProducerInterceptors []ProducerInterceptor
+	ConsumerInterceptors []ConsumerInterceptor
+	// guards topics, paused and held, which consumers can change while fetching
+	mu     sync.Mutex
+	paused map[partitionKey]bool
+	// left out of fetches by a ParallelConsumer while its worker catches up, apart from
+	// the callers pauses
+	held map[partitionKey]bool
 }
 
 func newBroker(hostname string, tp *TopicPartition) *Broker {
 
-	b := Broker{topics: []*TopicPartition{tp}, hostname: hostname}
+	b := Broker{topics: []*TopicPartition{tp}, hostname: hostname, Metrics: NoopMetrics{}, Logger: NoopLogger{}}
 
 	b.Partitioner = func(b *Broker) int {
 		return tp.Partition
@@ -76,7 +102,7 @@ func newBroker(hostname string, tp *TopicPartition) *Broker {
 
 func newMultiBroker(hostname string, tplist []*TopicPartition) *Broker {
 
-	b := Broker{topics: tplist, hostname: hostname}
+	b := Broker{topics: tplist, hostname: hostname, Metrics: NoopMetrics{}, Logger: NoopLogger{}}
 	partitions := make([]int, len(tplist))
 	for tpct, tp := range tplist {
 		partitions[tpct] = tp.Partition
@@ -94,7 +120,7 @@ func NewRandomPartitionedBroker(hostname string, topic string, partitions []int)
 		tp := TopicPartition{Topic: topic, Partition: partition}
 		tplist = append(tplist, &tp)
 	}
-	b := Broker{hostname: hostname, topics: tplist}
+	b := Broker{hostname: hostname, topics: tplist, Metrics: NoopMetrics{}, Logger: NoopLogger{}}
 	b.Partitioner = MakeRandomPartitioner(partitions)
 	return &b
 }
@@ -111,28 +137,94 @@ func MakeRandomPartitioner(partitions []int) Partitioner {
 func (b *Broker) connect() (conn *net.TCPConn, er error) {
 	raddr, err := net.ResolveTCPAddr(NETWORK, b.hostname)
 	if err != nil {
-		log.Println("Fatal Error: ", b.hostname, " ", err)
+		b.Logger.Error("could not resolve broker", "host", b.hostname, "err", err)
 		return nil, err
 	}
-	conn, err = net.DialTCP(NETWORK, nil, raddr)
+	if b.ConnectTimeout > 0 {
+		var c net.Conn
+		if c, err = net.DialTimeout(NETWORK, raddr.String(), b.ConnectTimeout); err == nil {
+			conn = c.(*net.TCPConn)
+		}
+	} else {
+		conn, err = net.DialTCP(NETWORK, nil, raddr)
+	}
 	if err != nil {
-		log.Println("Fatal Error: ", b.hostname, " ", err)
+		b.Logger.Error("could not connect to broker", "host", b.hostname, "err", err)
 		return nil, err
 	}
+	if b.SocketBufferSize > 0 {
+		conn.SetReadBuffer(b.SocketBufferSize)
+		conn.SetWriteBuffer(b.SocketBufferSize)
+	}
+	b.extendDeadline(conn)
 	return conn, er
 }
 
+// give the next request on conn SocketTimeout, for connections kept open across requests
+func (b *Broker) extendDeadline(conn *net.TCPConn) {
+	if b.SocketTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(b.SocketTimeout))
+	}
+}
+
 // returns buffer reader for single requests
 func (b *Broker) readResponse(conn *net.TCPConn) *ByteBuffer {
 	reader := bufio.NewReader(conn)
 	br := NewByteBuffer(1, reader)
+	br.logger = b.Logger
 	return br
 
 }
 
-// returns buffer reader for multiple fetch requests (offsets/fetchmsgs)
-func (b *Broker) readMultiResponse(conn *net.TCPConn) *ByteBuffer {
+// returns buffer reader for multiple fetch requests (offsets/fetchmsgs) of tpct topic/partitions
+func (b *Broker) readMultiResponse(conn *net.TCPConn, tpct int) *ByteBuffer {
 	reader := bufio.NewReader(conn)
-	br := NewByteBuffer(len(b.topics), reader)
+	br := NewByteBuffer(tpct, reader)
+	br.logger = b.Logger
 	return br
 }
+
+// the topic/partitions to fetch, leaving out paused and held ones
+func (b *Broker) fetchTopics() []*TopicPartition {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	tplist := make([]*TopicPartition, 0, len(b.topics))
+	for _, tp := range b.topics {
+		key := partitionKey{tp.Topic, tp.Partition}
+		if !b.paused[key] && !b.held[key] {
+			tplist = append(tplist, tp)
+		}
+	}
+	return tplist
+}
+
+// the topic/partitions being consumed, paused or not
+func (b *Broker) assignedTopics() []*TopicPartition {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.topics
+}
+
+// the offset of a topic/partition, under mu as the fetch loop moves it
+func (b *Broker) offset(tp *TopicPartition) uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return tp.Offset
+}
+
+// move a topic/partition to offset, under mu so Unassign can copy it during a fetch
+func (b *Broker) setOffset(tp *TopicPartition, offset uint64) {
+	b.mu.Lock()
+	tp.Offset = offset
+	b.mu.Unlock()
+}
+
+// the assigned topic/partition, callers hold mu
+func (b *Broker) assigned(topic string, partition int) *TopicPartition {
+	for _, tp := range b.topics {
+		if tp.Topic == topic && tp.Partition == partition {
+			return tp
+		}
+	}
+	return nil
+}
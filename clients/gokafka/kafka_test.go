@@ -1,10 +1,10 @@
 /*
  *  Copyright (c) 2011 NeuStar, Inc.
- *  All rights reserved.  
+ *  All rights reserved.
  *
  *  Licensed under the Apache License, Version 2.0 (the "License");
  *  you may not use this file except in compliance with the License.
- *  You may obtain a copy of the License at 
+ *  You may obtain a copy of the License at
  *
  *      http://www.apache.org/licenses/LICENSE-2.0
  *
@@ -13,9 +13,9 @@
  *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
  *  See the License for the specific language governing permissions and
  *  limitations under the License.
- *  
+ *
  *  NeuStar, the Neustar logo and related names and logos are registered
- *  trademarks, service marks or tradenames of NeuStar, Inc. All other 
+ *  trademarks, service marks or tradenames of NeuStar, Inc. All other
  *  product names, company names, marks, logos and symbols may be trademarks
  *  of their respective owners.
  */
@@ -25,8 +25,17 @@ package kafka
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
 	"log"
+	"math/rand"
+	"net"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 type MessageMatch struct {
@@ -150,7 +159,7 @@ func TestCompressedMessageEncoding(t *testing.T) {
 
 	msg := NewMessageWithCodec(uncompressedMsgBytes, DefaultCodecsMap[GZIP_COMPRESSION_ID])
 
-	// NOTE:  I could not get these tests to pass from apach trunk, i redid the values, 
+	// NOTE:  I could not get these tests to pass from apach trunk, i redid the values,
 	// the tests passed, and i sent the message from go producer -> scala consumer and it worked?
 	//  not sure where these values for expected came from
 	/*expectedPayload := []byte{0x1F, 0x8B, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x04,
@@ -163,8 +172,8 @@ func TestCompressedMessageEncoding(t *testing.T) {
 		0xFF, 0xFF, 0x0C, 0x6A, 0x82, 0x91, 0x11, 0x00, 0x00, 0x00}
 
 	// here is the difference  [       ]
-	//expected: 1F 8B 08 00 00 00 00 00 04 FF 62 60 60 E0 65 64 78 F1 39 8A AD 24 
-	// but got: 1F 8B 08 00 00 09 6E 88 04 FF 62 60 60 E0 65 64 78 F1 39 8A AD 24 
+	//expected: 1F 8B 08 00 00 00 00 00 04 FF 62 60 60 E0 65 64 78 F1 39 8A AD 24
+	// but got: 1F 8B 08 00 00 09 6E 88 04 FF 62 60 60 E0 65 64 78 F1 39 8A AD 24
 
 	//expectedHeader := []byte{0x00, 0x00, 0x00, 0x2F, 0x01, 0x01, 0x07, 0xFD, 0xC3, 0x76}
 	expectedHeader := []byte{0x00, 0x00, 0x00, 0x2F, 0x01, 0x01, 0x96, 0x71, 0xA6, 0xE8}
@@ -401,7 +410,7 @@ func TestMultiProduceEncoding(t *testing.T) {
 	       msg
 	    - 2nd topic/partition combo
 
-	  0 0 0 66 0 3 0 2  0 4 116 101 115 116 0 0 0 0    0 0 0 17  0 0 0 13 1 0 232 243 90 6 116 101 115 116 105 110 103 
+	  0 0 0 66 0 3 0 2  0 4 116 101 115 116 0 0 0 0    0 0 0 17  0 0 0 13 1 0 232 243 90 6 116 101 115 116 105 110 103
 	                    0 4 116 101 115 116 0 0 0 1    0 0 0 17  0 0 0 13 1 0 232 243 90 6 116 101 115 116 105 110 103
 	*/
 	testMessage(t, msg.Message, &tm, request)
@@ -424,8 +433,8 @@ func TestMultiProduceTopics(t *testing.T) {
 
 func TestMultiFetchEncoding(t *testing.T) {
 	/*
-	    [0 0 0 48 0 2 0 2 
-	   0 4 116 101 115 116 0 0 0 0 0 0 0 0 0 0 0 0 0 16 0 0 
+	    [0 0 0 48 0 2 0 2
+	   0 4 116 101 115 116 0 0 0 0 0 0 0 0 0 0 0 0 0 16 0 0
 	   0 4 116 101 115 116 0 0 0 1 0 0 0 0 0 0 0 0 0 16 0 0]
 	*/
 	con := NewMultiConsumer("localhost:9092", topics)
@@ -437,3 +446,1070 @@ func TestMultiFetchEncoding(t *testing.T) {
 	}
 
 }
+
+func TestStatsMetrics(t *testing.T) {
+	stats := NewStats()
+	stats.MessagesIn("test", 0, 2, 34)
+	stats.MessagesIn("test", 0, 1, 17)
+	stats.MessagesOut("test", 1, 3, 51)
+	stats.RequestLatency(REQUEST_FETCH, 3*time.Millisecond)
+	stats.RequestError(REQUEST_MULTIPRODUCE, io.EOF)
+	stats.Reconnect("localhost:9092")
+	stats.BufferDepth(7)
+	stats.ConsumerLag("test", 0, 100)
+
+	snap := stats.Snapshot()
+	if len(snap.Partitions) != 2 {
+		t.Fatalf("expected 2 partitions but got %d", len(snap.Partitions))
+	}
+	p0 := snap.Partitions[0]
+	if p0.Partition != 0 || p0.MessagesIn != 3 || p0.BytesIn != 51 || p0.Lag != 100 {
+		t.Fatalf("partition 0 stats incorrect %+v", p0)
+	}
+	if snap.Partitions[1].MessagesOut != 3 || snap.Partitions[1].BytesOut != 51 {
+		t.Fatalf("partition 1 stats incorrect %+v", snap.Partitions[1])
+	}
+	if snap.Latency["fetch"].Count != 1 || snap.Errors["multiproduce"] != 1 || snap.BufferDepth != 7 {
+		t.Fatalf("request stats incorrect %+v", snap)
+	}
+
+	buf := bytes.NewBuffer([]byte{})
+	stats.WritePrometheus(buf)
+	for _, line := range []string{
+		`kafka_messages_in_total{topic="test",partition="0"} 3`,
+		`kafka_consumer_lag_bytes{topic="test",partition="0"} 100`,
+		`kafka_request_latency_seconds_bucket{request="fetch",le="0.005"} 1`,
+		`kafka_request_latency_seconds_bucket{request="fetch",le="0.001"} 0`,
+		`kafka_request_errors_total{request="multiproduce"} 1`,
+		`kafka_reconnects_total{broker="localhost:9092"} 1`,
+		`kafka_producer_buffer_depth 7`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Fatalf("expected prometheus output to contain %s\n%s", line, buf.String())
+		}
+	}
+}
+
+func TestStdLogger(t *testing.T) {
+	out := bytes.NewBuffer([]byte{})
+	logger := NewStdLogger(log.New(out, "", 0), LogWarn)
+	logger.Debug("dropped", "topic", "test")
+	logger.Warn("bad offset id, resetting", "topic", "test", "partition", 1, "offset", uint64(42))
+
+	expected := "WARN bad offset id, resetting topic=test partition=1 offset=42\n"
+	if out.String() != expected {
+		t.Fatalf("expected: %q but got: %q", expected, out.String())
+	}
+
+	// corrupt checksums are reported through the logger, not the global log
+	out.Reset()
+	packet := NewMessage([]byte("testing")).Encode()
+	packet[len(packet)-1] = 'G'
+	if _, msgs := decode(packet, DefaultCodecsMap, logger); len(msgs) != 0 {
+		t.Fatalf("expected corrupt message to be dropped")
+	}
+	if !strings.HasPrefix(out.String(), "ERROR checksum mismatch") {
+		t.Fatalf("expected checksum error logged but got: %q", out.String())
+	}
+
+	// nil falls back to the noop implementations instead of panicking on use
+	consumer := NewBrokerConsumer("localhost:1", "test", 0, 0, 1024)
+	consumer.SetLogger(nil)
+	consumer.SetMetrics(nil)
+	publisher := NewBrokerPublisher("localhost:1", "test", 0)
+	publisher.SetLogger(nil)
+	publisher.SetMetrics(nil)
+	if _, err := consumer.Consume(func(string, int, *Message) {}); err == nil {
+		t.Fatalf("expected a connection error")
+	}
+	if _, err := publisher.Publish(NewMessage([]byte("testing"))); err == nil {
+		t.Fatalf("expected a connection error")
+	}
+}
+
+func TestMirrorWrapCodecs(t *testing.T) {
+	wrapper := NewCompressedMessages(NewMessage([]byte("testing")), NewMessage([]byte("multiple")))
+	_, compressed := DecodeWithDefaultCodecs(wrapper.Encode())
+	_, plain := DecodeWithDefaultCodecs(NewMessage([]byte("messages")).Encode())
+	if len(compressed) != 2 || compressed[0].Codec() != GZIP_COMPRESSION_ID || plain[0].Codec() != NO_COMPRESSION_ID {
+		t.Fatalf("decoded codecs incorrect")
+	}
+	msgs := append(compressed, plain...)
+
+	mirror := NewMirror(NewRandomPartitionedBroker("localhost:9092", "test", []int{0}))
+	wrapped := mirror.wrap(msgs, DefaultCodecsMap)
+	if len(wrapped) != 2 || wrapped[0].compression != GZIP_COMPRESSION_ID || wrapped[1].compression != NO_COMPRESSION_ID {
+		t.Fatalf("expected source codecs to be preserved, got %d messages", len(wrapped))
+	}
+	_, inner := DecodeWithDefaultCodecs(wrapped[0].Encode())
+	if len(inner) != 2 || inner[1].PayloadString() != "multiple" {
+		t.Fatalf("compressed wrapper payload incorrect")
+	}
+
+	mirror.Codec = DefaultCodecsMap[NO_COMPRESSION_ID]
+	if wrapped = mirror.wrap(msgs, DefaultCodecsMap); len(wrapped) != 3 {
+		t.Fatalf("expected 3 uncompressed messages but got %d", len(wrapped))
+	}
+	mirror.Codec = DefaultCodecsMap[GZIP_COMPRESSION_ID]
+	if wrapped = mirror.wrap(msgs, DefaultCodecsMap); len(wrapped) != 1 {
+		t.Fatalf("expected 1 compressed message but got %d", len(wrapped))
+	}
+}
+
+func TestOffsetCheckpoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mirror.checkpoint")
+	checkpoint, err := LoadOffsetCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp := &TopicPartition{Topic: "test", Partition: 1, Offset: 4096}
+	if _, ok := checkpoint.Offset("localhost:9092", tp); ok {
+		t.Fatalf("expected empty checkpoint")
+	}
+	checkpoint.Set("localhost:9092", tp)
+	if err = checkpoint.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	checkpoint, err = LoadOffsetCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset, ok := checkpoint.Offset("localhost:9092", tp); !ok || offset != 4096 {
+		t.Fatalf("expected offset 4096 but got %d", offset)
+	}
+	if _, ok := checkpoint.Offset("otherhost:9092", tp); ok {
+		t.Fatalf("expected offsets to be per broker")
+	}
+}
+
+func TestTopicFilters(t *testing.T) {
+	whitelist, err := NewWhitelist(" events.*, test ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	blacklist, err := NewBlacklist("events.*,test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for topic, allowed := range map[string]bool{
+		"test":         true,
+		"test2":        false,
+		"events":       true,
+		"events_click": true,
+		"myevents":     false,
+	} {
+		if whitelist.Matches(topic) != allowed {
+			t.Fatalf("whitelist should match %s: %v", topic, allowed)
+		}
+		if blacklist.Matches(topic) == allowed {
+			t.Fatalf("blacklist should match %s: %v", topic, !allowed)
+		}
+	}
+	if _, err = NewWhitelist("events("); err == nil {
+		t.Fatalf("expected invalid regex error")
+	}
+}
+
+type testEvent struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// stands in for a generated protobuf message
+type testProto struct {
+	data string
+}
+
+func (p *testProto) Marshal() ([]byte, error)    { return []byte(p.data), nil }
+func (p *testProto) Unmarshal(data []byte) error { p.data = string(data); return nil }
+
+func TestTypedSerializers(t *testing.T) {
+	payload, err := JSONEncoder[testEvent]{}.Encode(testEvent{"click", 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	consumer := NewTypedConsumer[testEvent](NewBrokerConsumer("localhost:9092", "test", 0, 0, 1048576), JSONDecoder[testEvent]{})
+	var decodeErrs []error
+	consumer.ErrorHandler = func(topic string, partition int, msg *Message, err error) {
+		decodeErrs = append(decodeErrs, err)
+	}
+	var events []testEvent
+	handler := consumer.HandlerFunc(func(topic string, partition int, event testEvent, msg *Message) {
+		events = append(events, event)
+	})
+	handler("test", 0, NewMessage(payload))
+	handler("test", 0, NewMessage([]byte("not json")))
+	handler("test", 0, NewMessage(payload))
+
+	if len(events) != 2 || events[0].Name != "click" || events[0].Count != 2 {
+		t.Fatalf("expected 2 decoded events but got %+v", events)
+	}
+	if len(decodeErrs) != 1 {
+		t.Fatalf("expected 1 decode error but got %d", len(decodeErrs))
+	}
+
+	protoBytes, _ := ProtoEncoder[testProto, *testProto]{}.Encode(&testProto{"wire bytes"})
+	proto, err := ProtoDecoder[testProto, *testProto]{}.Decode(protoBytes)
+	if err != nil || proto.data != "wire bytes" {
+		t.Fatalf("proto round trip failed %v %v", proto, err)
+	}
+	if str, _ := (StringDecoder{}).Decode([]byte("testing")); str != "testing" {
+		t.Fatalf("string decode failed %s", str)
+	}
+}
+
+func TestThrottler(t *testing.T) {
+	throttle := NewThrottler(1000, 0)
+	start := time.Now()
+	for i := 0; i < 20; i++ {
+		throttle.Wait(1, 100)
+	}
+	if elapsed := time.Since(start); elapsed < 19*time.Millisecond {
+		t.Fatalf("throttler did not limit messages, 20 messages took %v", elapsed)
+	}
+
+	throttle = NewThrottler(0, 100000)
+	start = time.Now()
+	throttle.Wait(1, 2000)
+	if elapsed := time.Since(start); elapsed < 19*time.Millisecond {
+		t.Fatalf("throttler did not limit bytes, 2000 bytes took %v", elapsed)
+	}
+
+	var unlimited *Throttler
+	start = time.Now()
+	for i := 0; i < 1000; i++ {
+		unlimited.Wait(1, 1000)
+		NewThrottler(0, 0).Wait(1, 1000)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Millisecond {
+		t.Fatalf("unlimited throttler waited %v", elapsed)
+	}
+}
+
+func TestConsumerConfig(t *testing.T) {
+	props, err := ParseProperties(strings.NewReader(`
+# consumer.properties
+groupid=test-group
+broker.list = 0:localhost:9092,1:localhost:9093
+fetch.size: 1048576
+autooffset.reset largest
+zk.connect=localhost:2181,\
+  localhost:2182
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := NewConsumerConfig(props)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.GroupId != "test-group" || config.FetchSize != 1048576 || config.AutoOffsetReset != "largest" {
+		t.Fatalf("consumer config incorrect %+v", config)
+	}
+	if config.ZkConnect != "localhost:2181,localhost:2182" {
+		t.Fatalf("line continuation incorrect %q", config.ZkConnect)
+	}
+	if len(config.BrokerList) != 2 || config.BrokerList[1] != "1:localhost:9093" {
+		t.Fatalf("broker list incorrect %v", config.BrokerList)
+	}
+	// defaults
+	if config.QueuedChunksMax != 10 || config.AutoCommitIntervalMs != 10000 || config.ConsumerTimeoutMs != -1 ||
+		!config.AutoCommit {
+		t.Fatalf("consumer defaults incorrect %+v", config)
+	}
+
+	for _, bad := range []map[string]string{
+		{"fetch.size": "big"},
+		{"autooffset.reset": "earliest"},
+		{"autocommit.enable": "yes please"},
+		{"broker.list": "localhost:9092"},
+	} {
+		if _, err = NewConsumerConfig(bad); err == nil {
+			t.Fatalf("expected error for %v", bad)
+		}
+	}
+
+	// a consumer.properties without broker.list loads, but needs zookeeper to create a consumer
+	if config, err = NewConsumerConfig(map[string]string{"groupid": "test-group", "zk.connect": "localhost:2181"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewConsumerWithConfig(config, "test"); err == nil {
+		t.Fatalf("expected error for missing broker.list")
+	}
+	config.BrokerList = []string{"0:localhost:1"}
+	if _, err = NewConsumerWithConfig(config, "test"); err == nil {
+		t.Fatalf("expected the reset offset lookup error, rather than starting from 0")
+	}
+
+	// <REQUEST_SIZE><ERROR_CODE><OFFSET COUNT><OFFSET>
+	offsets := append(append(uint32bytes(2+4+8), 0, 0), uint32bytes(1)...)
+	hostname, _ := fakeBroker(t, append(offsets, uint64ToUint64bytes(1024)...))
+	config.BrokerList = []string{"0:" + hostname}
+	config.SocketTimeoutMs = 500
+	consumer, err := NewConsumerWithConfig(config, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if consumer.broker.ConnectTimeout != 500*time.Millisecond || consumer.broker.SocketTimeout != 500*time.Millisecond ||
+		consumer.broker.SocketBufferSize != 64*1024 {
+		t.Fatalf("consumer socket options not set %+v", consumer.broker)
+	}
+}
+
+func TestProducerConfig(t *testing.T) {
+	config, err := NewProducerConfig(map[string]string{
+		"broker.list":       "0:localhost:9092",
+		"producer.type":     "async",
+		"compression.codec": "1",
+		"compressed.topics": "logs, events",
+		"batch.size":        "500",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ProducerType != "async" || config.CompressionCodec != GZIP_COMPRESSION_ID || config.BatchSize != 500 {
+		t.Fatalf("producer config incorrect %+v", config)
+	}
+	if len(config.CompressedTopics) != 2 || config.CompressedTopics[1] != "events" {
+		t.Fatalf("compressed topics incorrect %v", config.CompressedTopics)
+	}
+	if config.QueueTimeMs != 5000 || config.MaxMessageSize != 1000000 {
+		t.Fatalf("producer defaults incorrect %+v", config)
+	}
+	hosts, _ := ParseBrokerList(config.BrokerList)
+	if len(hosts) != 1 || hosts[0] != "localhost:9092" {
+		t.Fatalf("broker hosts incorrect %v", hosts)
+	}
+
+	for _, bad := range []map[string]string{
+		{"producer.type": "fast"},
+		{"compression.codec": "3"},
+		{"batch.size": "0"},
+	} {
+		if _, err = NewProducerConfig(bad); err == nil {
+			t.Fatalf("expected error for %v", bad)
+		}
+	}
+	if _, err = NewProducerWithConfig(DefaultProducerConfig(), "test"); err == nil {
+		t.Fatalf("expected error for missing broker.list")
+	}
+
+	// an async producer buffers until Close, with the socket options of the config
+	hostname, requests := fakeBroker(t, nil)
+	config.BrokerList = []string{"0:" + hostname}
+	config.ConnectTimeoutMs = 100
+	publisher, err := NewProducerWithConfig(config, "test", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if publisher.broker.ConnectTimeout != 100*time.Millisecond || publisher.broker.SocketTimeout != 30*time.Second ||
+		publisher.broker.SocketBufferSize != 100*1024 || publisher.broker.Compression == nil {
+		t.Fatalf("producer broker not configured %+v", publisher.broker)
+	}
+	if n, err := publisher.Publish(NewMessage([]byte("buffered"))); n != 0 || err != nil {
+		t.Fatalf("async publish should buffer, got %d %v", n, err)
+	}
+	select {
+	case <-requests:
+		t.Fatalf("async publish should not send before batch.size or queue.time")
+	default:
+	}
+	publisher.Close()
+	select {
+	case request := <-requests:
+		if binary.BigEndian.Uint16(request) != REQUEST_MULTIPRODUCE {
+			t.Fatalf("expected a multi produce request, got %d", binary.BigEndian.Uint16(request))
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Close should send the buffered messages")
+	}
+}
+
+func TestCompressionPolicy(t *testing.T) {
+	gzip := DefaultCodecsMap[GZIP_COMPRESSION_ID]
+	if NewCompressionPolicy(DefaultCodecsMap[NO_COMPRESSION_ID]) != nil {
+		t.Fatalf("no compression codec should not create a policy")
+	}
+	policy := NewCompressionPolicy(gzip, "logs")
+	if policy("logs") != gzip || policy("events") != nil {
+		t.Fatalf("policy should only compress the listed topics")
+	}
+	if NewCompressionPolicy(gzip)("events") != gzip {
+		t.Fatalf("policy without topics should compress all topics")
+	}
+
+	stats := NewStats()
+	broker := NewRandomPartitionedBroker("localhost:9092", "logs", []int{0})
+	broker.Metrics = stats
+	broker.Compression = policy
+	payload := []byte(strings.Repeat("a", 64))
+	preq := ProduceRequest{
+		"logs":   {0: {NewMessageTopic("logs", payload), NewMessageTopic("logs", append(payload, 'b'))}},
+		"events": {0: {NewMessageTopic("events", []byte("event"))}},
+	}
+	wire, rejected, err := broker.wireRequest(preq)
+	if len(rejected) != 0 || err != nil {
+		t.Fatalf("nothing should be rejected without a max message size %v", err)
+	}
+	if len(preq["logs"][0]) != 2 {
+		t.Fatalf("compress should not modify the buffered request")
+	}
+	if len(wire["events"][0]) != 1 || wire["events"][0][0].Message.compression != NO_COMPRESSION_ID {
+		t.Fatalf("events should not be compressed")
+	}
+	logs := wire["logs"][0]
+	if len(logs) != 1 || logs[0].Message.compression != GZIP_COMPRESSION_ID {
+		t.Fatalf("logs should be compressed into one wrapper message %+v", logs)
+	}
+	_, msgs := DecodeWithDefaultCodecs(logs[0].Message.Encode())
+	if len(msgs) != 2 || msgs[1].PayloadString() != preq["logs"][0][1].Message.PayloadString() {
+		t.Fatalf("compressed batch did not round trip %+v", msgs)
+	}
+
+	cs := stats.Snapshot().Compression["logs"]
+	if cs == nil || cs.RawBytes == 0 || cs.Ratio <= 1 {
+		t.Fatalf("compression stats incorrect %+v", cs)
+	}
+	if _, ok := stats.Snapshot().Compression["events"]; ok {
+		t.Fatalf("events should have no compression stats")
+	}
+
+	// already compressed messages stay in order with the runs of plain messages around them
+	wrapped := NewMessageTopic("logs", nil)
+	wrapped.Message = NewCompressedMessages(NewMessage([]byte("wrapped")))
+	mixed := ProduceRequest{"logs": {0: {NewMessageTopic("logs", []byte("first")), wrapped,
+		NewMessageTopic("logs", []byte("second")), NewMessageTopic("logs", []byte("third"))}}}
+	wire, _, _ = broker.wireRequest(mixed)
+	order := make([]string, 0)
+	for _, msg := range wire["logs"][0] {
+		_, inner := DecodeWithDefaultCodecs(msg.Message.Encode())
+		for _, m := range inner {
+			order = append(order, m.PayloadString())
+		}
+	}
+	if len(wire["logs"][0]) != 3 || strings.Join(order, ",") != "first,wrapped,second,third" {
+		t.Fatalf("mixed batch out of order %v", order)
+	}
+
+	// metrics without a Compression method are still accepted
+	broker.Metrics = NoopMetrics{}
+	if _, _, err = broker.wireRequest(preq); err != nil {
+		t.Fatal(err)
+	}
+
+	// Publish compresses with the policy too
+	hostname, requests := fakeBroker(t, nil)
+	publisher := NewBrokerPublisher(hostname, "logs", 0)
+	publisher.SetCompression(policy)
+	if _, err = publisher.BatchPublish(NewMessage([]byte("one")), NewMessage([]byte("two"))); err != nil {
+		t.Fatal(err)
+	}
+	request := <-requests
+	// <REQUEST_TYPE><TOPIC_LEN>logs<PARTITION><MESSAGE SET SIZE><MESSAGES>, the size was read by fakeBroker
+	_, published := DecodeWithDefaultCodecs(request[2+2+len("logs")+4+4:])
+	if len(published) != 2 || published[0].Codec() != GZIP_COMPRESSION_ID {
+		t.Fatalf("published messages should be compressed %+v", published)
+	}
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	broker := NewRandomPartitionedBroker("localhost:9092", "logs", []int{0})
+	broker.MaxMessageSize = 100
+	preq := ProduceRequest{"logs": {0: {
+		NewMessageTopic("logs", bytes.Repeat([]byte("a"), 50)),
+		NewMessageTopic("logs", bytes.Repeat([]byte("b"), 150)),
+	}}}
+	wire, rejected, err := broker.wireRequest(preq)
+	var sizeErr *MessageSizeTooLargeError
+	if !errors.As(err, &sizeErr) || sizeErr.Size != 150 || sizeErr.MaxSize != 100 || sizeErr.Topic != "logs" {
+		t.Fatalf("expected a MessageSizeTooLargeError but got %v", err)
+	}
+	if len(wire["logs"][0]) != 1 || len(rejected["logs"][0]) != 1 || rejected["logs"][0][0] != preq["logs"][0][1] {
+		t.Fatalf("only the large message should be rejected %v %v", wire, rejected)
+	}
+
+	// random payloads don't compress, so a batch of them is over the max
+	rnd := rand.New(rand.NewSource(1))
+	msgs := make([]*MessageTopic, 8)
+	for i := range msgs {
+		payload := make([]byte, 40)
+		rnd.Read(payload)
+		msgs[i] = NewMessageTopic("logs", payload)
+	}
+	broker.MaxMessageSize = 200
+	broker.Compression = NewCompressionPolicy(DefaultCodecsMap[GZIP_COMPRESSION_ID])
+	wire, rejected, err = broker.wireRequest(ProduceRequest{"logs": {0: msgs}})
+	if err == nil || len(rejected["logs"][0]) != 8 || len(wire) != 0 {
+		t.Fatalf("the compressed batch should be rejected %v", err)
+	}
+
+	broker.SplitLargeBatches = true
+	wire, rejected, err = broker.wireRequest(ProduceRequest{"logs": {0: msgs}})
+	if err != nil || len(rejected) != 0 || len(wire["logs"][0]) < 2 {
+		t.Fatalf("the compressed batch should be split %v %d", err, len(wire["logs"][0]))
+	}
+	decoded := 0
+	for _, msg := range wire["logs"][0] {
+		if len(msg.Message.payload) > 200 {
+			t.Fatalf("split batch is still too large %d", len(msg.Message.payload))
+		}
+		_, inner := DecodeWithDefaultCodecs(msg.Message.Encode())
+		decoded += len(inner)
+	}
+	if decoded != 8 {
+		t.Fatalf("split batches should hold all 8 messages, got %d", decoded)
+	}
+
+	// split batches stay in order around an already compressed message
+	wrapped := NewMessageTopic("logs", nil)
+	wrapped.Message = NewCompressedMessages(NewMessage([]byte("wrapped")))
+	mixed := append(append(append([]*MessageTopic{}, msgs[:4]...), wrapped), msgs[4:]...)
+	wire, rejected, err = broker.wireRequest(ProduceRequest{"logs": {0: mixed}})
+	if err != nil || len(rejected) != 0 {
+		t.Fatalf("the mixed batch should be split %v", err)
+	}
+	order := make([]string, 0)
+	for _, msg := range wire["logs"][0] {
+		_, inner := DecodeWithDefaultCodecs(msg.Message.Encode())
+		for _, m := range inner {
+			order = append(order, m.PayloadString())
+		}
+	}
+	expected := make([]string, 0)
+	for _, msg := range mixed {
+		_, inner := DecodeWithDefaultCodecs(msg.Message.Encode())
+		expected = append(expected, inner[0].PayloadString())
+	}
+	if strings.Join(order, ",") != strings.Join(expected, ",") {
+		t.Fatalf("split batches out of order %v", order)
+	}
+
+	publisher := NewBrokerPublisher("localhost:1", "logs", 0)
+	publisher.SetMaxMessageSize(10, false)
+	if _, err = publisher.Publish(NewMessage([]byte("more than ten bytes"))); !errors.As(err, &sizeErr) {
+		t.Fatalf("publish should fail with a MessageSizeTooLargeError before connecting, got %v", err)
+	}
+}
+
+func TestConsumerIterator(t *testing.T) {
+	tp := &TopicPartition{Topic: "test", Partition: 2}
+	msg := NewMessage([]byte("testing"))
+	mm := newMessageAndMetadata(tp, msg, 100, 40, false)
+	if mm.Topic != "test" || mm.Partition != 2 || mm.Offset != 100 || mm.NextOffset != 100 {
+		t.Fatalf("metadata incorrect %+v", mm)
+	}
+	if mm = newMessageAndMetadata(tp, msg, 100, 40, true); mm.NextOffset != 140 {
+		t.Fatalf("next offset of the last message should be past the message set %+v", mm)
+	}
+
+	it := NewBrokerConsumer("localhost:1", "test", 0, 0, 1024).Iterator(2, 50*time.Millisecond, 10*time.Millisecond)
+	if _, err := it.Next(context.Background()); err != ErrConsumerTimeout {
+		t.Fatalf("expected consumer timeout, got %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := it.Next(ctx); err != context.Canceled {
+		t.Fatalf("expected context canceled, got %v", err)
+	}
+	it.Close()
+	it.Close()
+	if _, err := it.Next(context.Background()); err != ErrIteratorClosed {
+		t.Fatalf("expected iterator closed, got %v", err)
+	}
+}
+
+func TestMessageAndMetadataPosition(t *testing.T) {
+	inner := []*Message{NewMessage([]byte("first")), NewMessage([]byte("second"))}
+	tp := &TopicPartition{Topic: "test", Partition: 1}
+	first := newMessageAndMetadata(tp, inner[0], 200, 60, false)
+	last := newMessageAndMetadata(tp, inner[1], 200, 60, true)
+	if string(last.Payload()) != "second" || last.Codec() != NO_COMPRESSION_ID {
+		t.Fatalf("payload or codec incorrect %s %d", last.Payload(), last.Codec())
+	}
+
+	checkpoint, err := LoadOffsetCheckpoint(filepath.Join(t.TempDir(), "offsets.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkpoint.Set("localhost:9092", first.Position())
+	if offset, _ := checkpoint.Offset("localhost:9092", tp); offset != 200 {
+		t.Fatalf("a message inside a message set should commit the set offset, got %d", offset)
+	}
+	checkpoint.Set("localhost:9092", last.Position())
+	if offset, _ := checkpoint.Offset("localhost:9092", tp); offset != 260 {
+		t.Fatalf("the last message should commit past the message set, got %d", offset)
+	}
+}
+
+func TestMessageBatch(t *testing.T) {
+	consumer := NewConsumerPartitions("localhost:1", "test", []int{0, 1}, 100, 1024)
+	tp0, tp1 := consumer.broker.topics[0], consumer.broker.topics[1]
+	msgs := []*MessageAndMetadata{
+		newMessageAndMetadata(tp0, NewMessage([]byte("a")), 100, 20, true),
+		newMessageAndMetadata(tp1, NewMessage([]byte("b")), 100, 30, false),
+		newMessageAndMetadata(tp1, NewMessage([]byte("c")), 100, 30, true),
+		newMessageAndMetadata(tp0, NewMessage([]byte("d")), 120, 20, true),
+	}
+	batch := newMessageBatch(msgs)
+	if len(batch.Messages) != 4 || len(batch.Ranges) != 2 {
+		t.Fatalf("batch incorrect %+v", batch)
+	}
+	if r := batch.Ranges[0]; r.Partition != 0 || r.FirstOffset != 100 || r.NextOffset != 140 || r.Count != 2 {
+		t.Fatalf("partition 0 range incorrect %+v", r)
+	}
+	if r := batch.Ranges[1]; r.Partition != 1 || r.FirstOffset != 100 || r.NextOffset != 130 || r.Count != 2 {
+		t.Fatalf("partition 1 range incorrect %+v", r)
+	}
+
+	committed := consumer.committedOffsets()
+	tp0.Offset, tp1.Offset = 500, 500
+	committed.rewind(consumer.broker)
+	if tp0.Offset != 100 || tp1.Offset != 100 {
+		t.Fatalf("failed batch should rewind the offsets %d %d", tp0.Offset, tp1.Offset)
+	}
+	committed.commit(newMessageBatch(msgs[:1]))
+	tp0.Offset, tp1.Offset = 500, 500
+	committed.rewind(consumer.broker)
+	if tp0.Offset != 120 || tp1.Offset != 100 {
+		t.Fatalf("rewind should keep the handled batch %d %d", tp0.Offset, tp1.Offset)
+	}
+
+	// partitions assigned later are rewound to their first fetched message set
+	tp2 := &TopicPartition{Topic: "test", Partition: 2, Offset: 300, MaxSize: 1024}
+	consumer.Assign(tp2)
+	committed.track(consumer.broker, newMessageAndMetadata(tp2, NewMessage([]byte("e")), 300, 20, true))
+	committed.track(consumer.broker, newMessageAndMetadata(tp2, NewMessage([]byte("f")), 320, 20, true))
+	tp2.Offset = 500
+	committed.rewind(consumer.broker)
+	if tp2.Offset != 300 {
+		t.Fatalf("assigned partition should be rewound to its first message %d", tp2.Offset)
+	}
+
+	called := false
+	if _, err := consumer.ConsumeBatch(func(batch *MessageBatch) error {
+		called = true
+		return nil
+	}); err == nil || called {
+		t.Fatalf("expected a connection error without calling the handler")
+	}
+}
+
+func TestParallelConsumerCommits(t *testing.T) {
+	consumer := NewConsumerPartitions("localhost:1", "test", []int{0, 1}, 100, 1024)
+	tp0, tp1 := consumer.broker.topics[0], consumer.broker.topics[1]
+	pc := NewParallelConsumer(consumer, 2, 2, func(mm *MessageAndMetadata) {})
+
+	// partition 0's worker is behind, dispatching partition 1 doesn't wait for it
+	pc.dispatch(newMessageAndMetadata(tp0, NewMessage([]byte("a")), 100, 20, true))
+	pc.dispatch(newMessageAndMetadata(tp0, NewMessage([]byte("b")), 120, 20, true))
+	pc.dispatch(newMessageAndMetadata(tp0, NewMessage([]byte("c")), 140, 20, true))
+	pc.dispatch(newMessageAndMetadata(tp1, NewMessage([]byte("d")), 100, 30, true))
+	pc.holdBehind()
+	if tplist := consumer.broker.fetchTopics(); len(tplist) != 1 || tplist[0] != tp1 {
+		t.Fatalf("partition 0 should be held back with a full queue %v", tplist)
+	}
+	if consumer.Paused("test", 0) {
+		t.Fatalf("holding a partition back is not a pause")
+	}
+
+	items, _ := pc.next(0)
+	if len(items) != 3 {
+		t.Fatalf("expected 3 messages for worker 0, got %d", len(items))
+	}
+	pc.complete(items[1])
+	if committed := pc.Committed(); committed[0].Offset != 100 {
+		t.Fatalf("offset should not advance past an unhandled message, got %d", committed[0].Offset)
+	}
+	pc.complete(items[0])
+	pc.complete(items[2])
+	items, _ = pc.next(1)
+	pc.complete(items[0])
+	committed := pc.Committed()
+	if committed[0].Offset != 160 || committed[1].Offset != 130 {
+		t.Fatalf("committed offsets incorrect %d %d", committed[0].Offset, committed[1].Offset)
+	}
+
+	// the callers pause outlasts the worker catching up
+	consumer.Pause("test", 0)
+	pc.holdBehind()
+	if !consumer.Paused("test", 0) || len(consumer.broker.fetchTopics()) != 1 {
+		t.Fatalf("catching up should not resume a partition the caller paused")
+	}
+	consumer.Resume("test", 0)
+
+	pc.dispatch(newMessageAndMetadata(tp1, NewMessage([]byte("e")), 130, 20, true))
+	pc.dispatch(newMessageAndMetadata(tp1, NewMessage([]byte("f")), 150, 20, true))
+	pc.holdBehind()
+	consumer.Pause("test", 0)
+	quit := make(chan bool, 1)
+	quit <- true
+	num, err := pc.Run(quit)
+	if err != nil || num != 2 {
+		t.Fatalf("run should handle the queued messages and stop cleanly on quit %d %v", num, err)
+	}
+	if len(consumer.broker.fetchTopics()) != 1 || !consumer.Paused("test", 0) {
+		t.Fatalf("run should fetch the partitions it held back, and keep the callers pauses")
+	}
+	if committed = pc.Committed(); committed[1].Offset != 170 {
+		t.Fatalf("queued messages should be committed once handled, got %d", committed[1].Offset)
+	}
+}
+
+func TestPauseAndAssign(t *testing.T) {
+	consumer := NewConsumerPartitions("localhost:1", "test", []int{0, 1, 2}, 0, 1024)
+	full := consumer.broker.EncodeConsumeRequestMultiFetch()
+
+	consumer.Pause("test", 1)
+	paused := consumer.broker.EncodeConsumeRequestMultiFetch()
+	if len(paused) != len(full)-(2+4+4+8+4) || paused[7] != 2 {
+		t.Fatalf("paused partition should be left out of the multifetch request %v", paused)
+	}
+	if bytes.Contains(paused, encodeTopicFetchBytes(consumer.broker.topics[1])) {
+		t.Fatalf("paused partition is still in the request")
+	}
+	consumer.Resume("test", 1)
+	if !bytes.Equal(consumer.broker.EncodeConsumeRequestMultiFetch(), full) {
+		t.Fatalf("resumed partition should be fetched again")
+	}
+
+	live := consumer.broker.assigned("test", 2)
+	tp := consumer.Unassign("test", 2)
+	if tp == nil || tp.Partition != 2 || len(consumer.broker.fetchTopics()) != 2 {
+		t.Fatalf("unassign incorrect %v", tp)
+	}
+	if tp == live {
+		t.Fatalf("unassign should return a copy the fetch can't move")
+	}
+	tp.Offset = 1024
+	consumer.Assign(tp, &TopicPartition{Topic: "test", Partition: 0})
+	tplist := consumer.broker.fetchTopics()
+	if len(tplist) != 3 || tplist[2].Partition != 2 || tplist[2].Offset != 1024 {
+		t.Fatalf("assign should add partition 2 back with its offset")
+	}
+	if consumer.Unassign("test", 5) != nil {
+		t.Fatalf("unassigned partition should return nil")
+	}
+}
+
+func encodeTopicFetchBytes(tp *TopicPartition) []byte {
+	buf := bytes.NewBuffer([]byte{})
+	EncodeTopicFetch(buf, tp)
+	return buf.Bytes()
+}
+
+func TestRetryPolicyDeadLetter(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		request, _ := io.ReadAll(conn)
+		received <- request
+	}()
+
+	tp := &TopicPartition{Topic: "test", Partition: 3}
+	mm := newMessageAndMetadata(tp, NewMessage([]byte("bad record")), 4096, 30, true)
+	attempts := 0
+	failing := func(mm *MessageAndMetadata) error {
+		attempts++
+		return errors.New("cannot parse record")
+	}
+
+	dead := NewBrokerPublisher(listener.Addr().String(), "test.dlq", 0)
+	policy := NewRetryPolicy(3, time.Millisecond, dead)
+	if err = policy.handle(failing, mm); err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 3 {
+		t.Fatalf("expected 3 attempts, got %d", attempts)
+	}
+	var request []byte
+	select {
+	case request = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("dead letter was not published")
+	}
+	// <REQUEST_SIZE><REQUEST_TYPE><TOPIC_LEN>test.dlq<PARTITION><MESSAGE SET SIZE><MESSAGES>
+	_, msgs := DecodeWithDefaultCodecs(request[4+2+2+len("test.dlq")+4+4:])
+	if len(msgs) != 1 {
+		t.Fatalf("expected one dead letter message, got %d", len(msgs))
+	}
+	dl, err := ParseDeadLetter(msgs[0].Payload())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dl.Topic != "test" || dl.Partition != 3 || dl.Offset != 4096 || dl.Error != "cannot parse record" ||
+		dl.Attempts != 3 || string(dl.Payload) != "bad record" {
+		t.Fatalf("dead letter incorrect %+v", dl)
+	}
+
+	attempts = 0
+	succeedsSecond := func(mm *MessageAndMetadata) error {
+		if attempts++; attempts < 2 {
+			return errors.New("try again")
+		}
+		return nil
+	}
+	if err = NewRetryPolicy(3, time.Millisecond, nil).Handler(succeedsSecond)(mm); err != nil || attempts != 2 {
+		t.Fatalf("expected the retry to succeed on the second attempt, got %d %v", attempts, err)
+	}
+
+	// without a dead letter publisher the handlers error is returned, not dropped
+	attempts = 0
+	if err = NewRetryPolicy(2, time.Millisecond, nil).Handler(failing)(mm); err == nil ||
+		err.Error() != "cannot parse record" || attempts != 2 {
+		t.Fatalf("expected the handler error without a dead letter publisher, got %d %v", attempts, err)
+	}
+
+	// a dead letter that can't be published is returned, not dropped
+	attempts = 0
+	unreachable := NewRetryPolicy(2, time.Millisecond, NewBrokerPublisher("127.0.0.1:1", "test.dlq", 0))
+	if err = unreachable.Handler(failing)(mm); err == nil || attempts != 2 {
+		t.Fatalf("expected the dead letter publish error, got %v", err)
+	}
+
+	// and ConsumeWithRetry rewinds to the failed message
+	source, _ := fakeBroker(t, fetchResponse("good", "bad", "after"))
+	consumer := NewBrokerConsumer(source, "test", 0, 100, 1024)
+	handled := make([]string, 0)
+	num, err := consumer.ConsumeWithRetry(func(mm *MessageAndMetadata) error {
+		if string(mm.Payload()) == "bad" {
+			return errors.New("cannot parse record")
+		}
+		handled = append(handled, string(mm.Payload()))
+		return nil
+	}, unreachable)
+	expected := 100 + uint64(len(NewMessage([]byte("good")).Encode()))
+	if err == nil || num != 1 || len(handled) != 1 || consumer.broker.topics[0].Offset != expected {
+		t.Fatalf("expected a rewind to the failed message, got %d %v %d", num, handled, consumer.broker.topics[0].Offset)
+	}
+}
+
+type scrubInterceptor struct {
+	acked  []*MessageTopic
+	ackErr error
+}
+
+func (s *scrubInterceptor) OnSend(msg *MessageTopic) *MessageTopic {
+	if string(msg.Message.Payload()) == "drop" {
+		return nil
+	}
+	return NewMessageTopic(msg.Topic, bytes.Replace(msg.Message.Payload(), []byte("secret"), []byte("******"), -1))
+}
+
+func (s *scrubInterceptor) OnAcknowledgement(msgs []*MessageTopic, err error) {
+	s.acked = append(s.acked, msgs...)
+	s.ackErr = err
+}
+
+func (s *scrubInterceptor) OnConsume(mm *MessageAndMetadata) *MessageAndMetadata {
+	if string(mm.Payload()) == "drop" {
+		return nil
+	}
+	mm.Message = NewMessage(bytes.Replace(mm.Payload(), []byte("secret"), []byte("******"), -1))
+	return mm
+}
+
+// a broker that answers one request with response, and passes on the request it read.
+// Later connections are refused
+func fakeBroker(t *testing.T, response []byte) (string, chan []byte) {
+	return fakeBrokerConns(t, response)
+}
+
+// a broker answering one request on each of len(responses) connections, in order
+func fakeBrokerConns(t *testing.T, responses ...[]byte) (string, chan []byte) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	requests := make(chan []byte, len(responses))
+	go func() {
+		defer listener.Close()
+		for _, response := range responses {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			size := make([]byte, 4)
+			if _, err = io.ReadFull(conn, size); err != nil {
+				conn.Close()
+				return
+			}
+			request := make([]byte, binary.BigEndian.Uint32(size))
+			if _, err = io.ReadFull(conn, request); err != nil {
+				conn.Close()
+				return
+			}
+			requests <- request
+			conn.Write(response)
+			conn.Close()
+		}
+	}()
+	return listener.Addr().String(), requests
+}
+
+func TestMultiFetchOffsetOutOfRange(t *testing.T) {
+	messageSet := NewMessage([]byte("kept")).Encode()
+	multi := append(uint32bytes(2), 0, 1)
+	multi = append(append(multi, uint32bytes(uint32(len(messageSet)+2))...), 0, 0)
+	multi = append(multi, messageSet...)
+	response := append(append(uint32bytes(uint32(len(multi)+2)), 0, 0), multi...)
+	// <REQUEST_SIZE><ERROR_CODE><OFFSET COUNT><OFFSET>
+	offsets := append(append(uint32bytes(2+4+8), 0, 0), uint32bytes(1)...)
+	offsets = append(offsets, uint64ToUint64bytes(2048)...)
+
+	hostname, _ := fakeBrokerConns(t, response, offsets)
+	consumer := NewConsumerPartitions(hostname, "test", []int{0, 1}, 100, 1024)
+	payloads := make([]string, 0)
+	num, err := consumer.ConsumeMetadata(func(mm *MessageAndMetadata) {
+		payloads = append(payloads, string(mm.Payload()))
+	})
+	if err != nil || num != 1 || len(payloads) != 1 || payloads[0] != "kept" {
+		t.Fatalf("the other partition should still be consumed %d %v %v", num, payloads, err)
+	}
+	tp0, tp1 := consumer.broker.topics[0], consumer.broker.topics[1]
+	if tp0.Offset != 2048 || tp1.Offset != 100+uint64(len(messageSet)) {
+		t.Fatalf("offset out of range should reset to the earliest offset %d %d", tp0.Offset, tp1.Offset)
+	}
+}
+
+func TestInterceptors(t *testing.T) {
+	interceptor := &scrubInterceptor{}
+
+	hostname, requests := fakeBroker(t, nil)
+	broker := newBroker(hostname, &TopicPartition{Topic: "test", Partition: 0})
+	broker.ProducerInterceptors = []ProducerInterceptor{interceptor}
+	send, conn, err := NewBufferedSender(broker, 10000, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	send(NewMessageTopic("test", []byte("my secret")))
+	send(NewMessageTopic("test", []byte("drop")))
+	send(nil)
+	request := <-requests
+	if !bytes.Contains(request, []byte("my ******")) || bytes.Contains(request, []byte("secret")) ||
+		bytes.Contains(request, []byte("drop")) {
+		t.Fatalf("produce request was not intercepted %q", request)
+	}
+	if len(interceptor.acked) != 1 || interceptor.ackErr != nil {
+		t.Fatalf("expected one acknowledged message, got %d %v", len(interceptor.acked), interceptor.ackErr)
+	}
+
+	var messageSet []byte
+	for _, payload := range []string{"drop", "my secret"} {
+		messageSet = append(messageSet, NewMessage([]byte(payload)).Encode()...)
+	}
+	response := append(uint32bytes(uint32(len(messageSet)+2)), 0, 0)
+	hostname, _ = fakeBroker(t, append(response, messageSet...))
+	consumer := NewBrokerConsumer(hostname, "test", 0, 0, 1024)
+	consumer.AddInterceptors(interceptor)
+	handled := make([]string, 0)
+	if _, err = consumer.Consume(func(topic string, partition int, msg *Message) {
+		handled = append(handled, string(msg.Payload()))
+	}); err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	if len(handled) != 1 || handled[0] != "my ******" {
+		t.Fatalf("consumed messages were not intercepted %v", handled)
+	}
+}
+
+// a fetch response with a message set of payloads
+func fetchResponse(payloads ...string) []byte {
+	var messageSet []byte
+	for _, payload := range payloads {
+		messageSet = append(messageSet, NewMessage([]byte(payload)).Encode()...)
+	}
+	return append(append(uint32bytes(uint32(len(messageSet)+2)), 0, 0), messageSet...)
+}
+
+func TestMirrorCheckpointsSentBatches(t *testing.T) {
+	response := fetchResponse("first", "second")
+	setSize := uint64(len(response) - 6)
+
+	runMirror := func(target string) (*Mirror, *TopicPartition) {
+		source, _ := fakeBroker(t, response)
+		tp := &TopicPartition{Topic: "test", Partition: 0, MaxSize: 1024}
+		mirror := NewMirror(NewRandomPartitionedBroker(target, "test", []int{0}),
+			&MirrorSource{Hostname: source, Topics: []*TopicPartition{tp}})
+		mirror.CheckpointFile = filepath.Join(t.TempDir(), "mirror.checkpoint")
+		mirror.PollTimeoutMs = 10
+		mirror.BufferMaxSize = 1
+		quit := make(chan bool, 1)
+		go func() {
+			time.Sleep(200 * time.Millisecond)
+			quit <- true
+		}()
+		if err := mirror.Run(quit); err != nil {
+			t.Fatal(err)
+		}
+		return mirror, tp
+	}
+
+	// the target is down, the batch is not checkpointed and is consumed again
+	mirror, tp := runMirror("localhost:1")
+	if tp.Offset != 0 {
+		t.Fatalf("a failed send should rewind the source offset, got %d", tp.Offset)
+	}
+	checkpoint, err := LoadOffsetCheckpoint(mirror.CheckpointFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := checkpoint.Offset(mirror.Sources[0].Hostname, tp); ok {
+		t.Fatalf("a failed send should not be checkpointed")
+	}
+
+	target, requests := fakeBroker(t, nil)
+	mirror, tp = runMirror(target)
+	request := <-requests
+	if !bytes.Contains(request, []byte("first")) || !bytes.Contains(request, []byte("second")) {
+		t.Fatalf("mirrored request incorrect %q", request)
+	}
+	if checkpoint, err = LoadOffsetCheckpoint(mirror.CheckpointFile); err != nil {
+		t.Fatal(err)
+	}
+	if offset, ok := checkpoint.Offset(mirror.Sources[0].Hostname, tp); !ok || offset != setSize {
+		t.Fatalf("sent batch should be checkpointed at %d, got %d", setSize, offset)
+	}
+}
+
+func TestReplayEndOffsetError(t *testing.T) {
+	source := &TopicPartition{Topic: "test", Partition: 0, MaxSize: 1024}
+	replay := NewReplay("localhost:1", source, NewRandomPartitionedBroker("localhost:1", "test", []int{0}), "replayed")
+	if num, err := replay.Run(make(chan bool)); err == nil || num != 0 {
+		t.Fatalf("expected an error getting the end offset, got %d %v", num, err)
+	}
+	if _, err := OffsetBefore("localhost:1", source, time.Now()); err == nil {
+		t.Fatalf("expected an error getting the offset before a time")
+	}
+
+	// the buffered messages are published before Run returns
+	response := fetchResponse("first", "second")
+	hostname, _ := fakeBroker(t, response)
+	target, requests := fakeBroker(t, nil)
+	replay = NewReplay(hostname, source, NewRandomPartitionedBroker(target, "test", []int{0}), "replayed")
+	replay.EndOffset = uint64(len(response) - 6)
+	replay.BufferMaxMs = 10000
+	if num, err := replay.Run(make(chan bool)); err != nil || num != 2 {
+		t.Fatalf("expected 2 messages replayed, got %d %v", num, err)
+	}
+	select {
+	case request := <-requests:
+		if !bytes.Contains(request, []byte("first")) || !bytes.Contains(request, []byte("second")) {
+			t.Fatalf("replayed messages not in the request %q", request)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("replayed messages were not sent")
+	}
+}
@@ -0,0 +1,110 @@
+/*
+ *  Copyright (c) 2011 NeuStar, Inc.
+ *  All rights reserved.
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  NeuStar, the Neustar logo and related names and logos are registered
+ *  trademarks, service marks or tradenames of NeuStar, Inc. All other
+ *  product names, company names, marks, logos and symbols may be trademarks
+ *  of their respective owners.
+ */
+
+package kafka
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+)
+
+type LogLevel int
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarn
+	LogError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogDebug:
+		return "DEBUG"
+	case LogInfo:
+		return "INFO"
+	case LogWarn:
+		return "WARN"
+	case LogError:
+		return "ERROR"
+	}
+	return "UNKNOWN"
+}
+
+// Logger receives the log output of consumers and producers.  Fields are
+// alternating key/value pairs such as "topic", "test", "partition", 0
+type Logger interface {
+	Debug(msg string, fields ...interface{})
+	Info(msg string, fields ...interface{})
+	Warn(msg string, fields ...interface{})
+	Error(msg string, fields ...interface{})
+}
+
+// the default Logger, discards everything
+type NoopLogger struct{}
+
+func (NoopLogger) Debug(msg string, fields ...interface{}) {}
+func (NoopLogger) Info(msg string, fields ...interface{})  {}
+func (NoopLogger) Warn(msg string, fields ...interface{})  {}
+func (NoopLogger) Error(msg string, fields ...interface{}) {}
+
+// a Logger that writes to a standard library logger, dropping anything below level
+type StdLogger struct {
+	logger *log.Logger
+	level  LogLevel
+}
+
+// Create a Logger writing to the given log.Logger, if nil the global logger is used
+func NewStdLogger(logger *log.Logger, level LogLevel) *StdLogger {
+	return &StdLogger{logger: logger, level: level}
+}
+
+func (l *StdLogger) Debug(msg string, fields ...interface{}) { l.output(LogDebug, msg, fields) }
+func (l *StdLogger) Info(msg string, fields ...interface{})  { l.output(LogInfo, msg, fields) }
+func (l *StdLogger) Warn(msg string, fields ...interface{})  { l.output(LogWarn, msg, fields) }
+func (l *StdLogger) Error(msg string, fields ...interface{}) { l.output(LogError, msg, fields) }
+
+func (l *StdLogger) output(level LogLevel, msg string, fields []interface{}) {
+	if level < l.level {
+		return
+	}
+	line := level.String() + " " + msg + formatFields(fields)
+	if l.logger != nil {
+		l.logger.Output(3, line)
+	} else {
+		log.Output(3, line)
+	}
+}
+
+// format key/value pairs as " key=value key=value"
+func formatFields(fields []interface{}) string {
+	buf := bytes.NewBuffer([]byte{})
+	for i := 0; i < len(fields); i += 2 {
+		if i+1 < len(fields) {
+			fmt.Fprintf(buf, " %v=%v", fields[i], fields[i+1])
+		} else {
+			fmt.Fprintf(buf, " %v", fields[i])
+		}
+	}
+	return buf.String()
+}
@@ -25,6 +25,7 @@ package kafka
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"hash/crc32"
 	"log"
 )
@@ -43,6 +44,7 @@ type Message struct {
 	payload     []byte
 	offset      uint64 // only used after decoding
 	totalLength uint32 // total length of the raw message (from decoding)
+	codec       byte   // compression of the message set it was delivered in (from decoding)
 }
 
 // Used for sending messages
@@ -62,6 +64,12 @@ func (m *Message) TotalLen() uint64 {
 	return uint64(m.totalLength) + 4
 }
 
+// the compression codec id this message was delivered with, for messages decoded
+// out of a compressed message set this is the codec of the wrapper message
+func (m *Message) Codec() byte {
+	return m.codec
+}
+
 func (m *Message) Payload() []byte {
 	return m.payload
 }
@@ -102,11 +110,16 @@ func NewCompressedMessage(payload []byte) *Message {
 }
 
 func NewCompressedMessages(messages ...*Message) *Message {
+	return NewCompressedMessagesWithCodec(DefaultCodecsMap[GZIP_COMPRESSION_ID], messages...)
+}
+
+// Create a single wrapper Message, holding the messages compressed with codec
+func NewCompressedMessagesWithCodec(codec PayloadCodec, messages ...*Message) *Message {
 	buf := bytes.NewBuffer([]byte{})
 	for _, message := range messages {
 		buf.Write(message.Encode())
 	}
-	return NewMessageWithCodec(buf.Bytes(), DefaultCodecsMap[GZIP_COMPRESSION_ID])
+	return NewMessageWithCodec(buf.Bytes(), codec)
 }
 
 // MESSAGE SET: <MESSAGE LENGTH: uint32><MAGIC: 1 byte><COMPRESSION: 1 byte><CHECKSUM: uint32><MESSAGE PAYLOAD: bytes>
@@ -128,6 +141,10 @@ func DecodeWithDefaultCodecs(packet []byte) (uint32, []*Message) {
 }
 
 func Decode(packet []byte, payloadCodecsMap map[byte]PayloadCodec) (uint32, []*Message) {
+	return decode(packet, payloadCodecsMap, NoopLogger{})
+}
+
+func decode(packet []byte, payloadCodecsMap map[byte]PayloadCodec, logger Logger) (uint32, []*Message) {
 
 	messages := []*Message{}
 	packetLen := uint32(len(packet))
@@ -152,7 +169,7 @@ func Decode(packet []byte, payloadCodecsMap map[byte]PayloadCodec) (uint32, []*M
 			// so return the ammount consumed 
 			return msgStart, messages
 		}
-		message := decodeMessage(packet[msgStart:msgStart+4+length], length, payloadCodecsMap)
+		message := decodeMessage(packet[msgStart:msgStart+4+length], length, payloadCodecsMap, logger)
 		msgStart = length + msgStart + 4
 
 		if length > 0 && message != nil {
@@ -163,11 +180,15 @@ func Decode(packet []byte, payloadCodecsMap map[byte]PayloadCodec) (uint32, []*M
 				for messageLenLeft > 0 {
 					start := payloadLen - messageLenLeft
 					length = binary.BigEndian.Uint32(message.payload[start:])
-					innerMsg := decodeMessage(message.payload[start:start+length+4], length, payloadCodecsMap)
+					innerMsg := decodeMessage(message.payload[start:start+length+4], length, payloadCodecsMap, logger)
 					messageLenLeft = messageLenLeft - length - 4 // message length uint32
+					if innerMsg != nil {
+						innerMsg.codec = message.compression
+					}
 					messages = append(messages, innerMsg)
 				}
 			} else {
+				message.codec = message.compression
 				messages = append(messages, message)
 			}
 		}
@@ -176,10 +197,10 @@ func Decode(packet []byte, payloadCodecsMap map[byte]PayloadCodec) (uint32, []*M
 	return uint32(len(packet)), messages
 }
 
-func decodeMessage(packet []byte, length uint32, payloadCodecsMap map[byte]PayloadCodec) *Message {
+func decodeMessage(packet []byte, length uint32, payloadCodecsMap map[byte]PayloadCodec, logger Logger) *Message {
 
 	if length != uint32(len(packet[4:])) {
-		log.Printf("length mismatch, expected at least : %d, was: %d\n", length, len(packet[4:]))
+		logger.Error("length mismatch", "expected", length, "was", len(packet[4:]))
 		return nil
 	}
 	msg := Message{}
@@ -198,15 +219,15 @@ func decodeMessage(packet []byte, length uint32, payloadCodecsMap map[byte]Paylo
 		payloadLength := length - NO_LEN_HEADER_SIZE
 		rawPayload = packet[10 : 10+payloadLength]
 	} else {
-		log.Printf("incorrect magic, expected: %X was: %X\n", MAGIC_DEFAULT, msg.magic)
+		logger.Error("incorrect magic", "expected", MAGIC_DEFAULT, "was", msg.magic)
 		return nil
 	}
 
 	payloadChecksum := make([]byte, 4)
 	binary.BigEndian.PutUint32(payloadChecksum, crc32.ChecksumIEEE(rawPayload))
 	if !bytes.Equal(payloadChecksum, msg.checksum[:]) {
-		msg.Print()
-		log.Printf("checksum mismatch, expected: % X was: % X\n", payloadChecksum, msg.checksum[:])
+		logger.Error("checksum mismatch", "expected", fmt.Sprintf("% X", payloadChecksum),
+			"was", fmt.Sprintf("% X", msg.checksum[:]), "length", msg.totalLength)
 		return nil
 	}
 	msg.payload = payloadCodecsMap[msg.compression].Decode(rawPayload)
@@ -0,0 +1,375 @@
+/*
+ *  Copyright (c) 2011 NeuStar, Inc.
+ *  All rights reserved.
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  NeuStar, the Neustar logo and related names and logos are registered
+ *  trademarks, service marks or tradenames of NeuStar, Inc. All other
+ *  product names, company names, marks, logos and symbols may be trademarks
+ *  of their respective owners.
+ */
+
+package kafka
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Metrics is the instrumentation hook called by consumers and producers.
+// Implementations must be safe for concurrent use, embed NoopMetrics to only
+// implement the events you care about.
+type Metrics interface {
+
+	// messages and bytes decoded from a fetch for a topic/partition
+	MessagesIn(topic string, partition int, msgs int, bytes int)
+
+	// messages and bytes written in a produce request for a topic/partition
+	MessagesOut(topic string, partition int, msgs int, bytes int)
+
+	// round trip time of a request to the broker (fetch, produce, offsets)
+	RequestLatency(requestType RequestType, d time.Duration)
+
+	// a request to the broker failed
+	RequestError(requestType RequestType, err error)
+
+	// the connection to hostname was re-established
+	Reconnect(hostname string)
+
+	// number of messages waiting in the producer buffer
+	BufferDepth(msgs int)
+
+	// bytes between the consumers offset and the latest offset of a topic/partition
+	ConsumerLag(topic string, partition int, lag uint64)
+}
+
+// Metrics implementations that also implement CompressionMetrics are told the
+// compression ratio of each batch the producer compresses
+type CompressionMetrics interface {
+	// a batch for topic was compressed from rawBytes to compressedBytes
+	Compression(topic string, rawBytes int, compressedBytes int)
+}
+
+// the default Metrics, discards everything
+type NoopMetrics struct{}
+
+func (NoopMetrics) MessagesIn(topic string, partition int, msgs int, bytes int)  {}
+func (NoopMetrics) MessagesOut(topic string, partition int, msgs int, bytes int) {}
+func (NoopMetrics) RequestLatency(requestType RequestType, d time.Duration)      {}
+func (NoopMetrics) RequestError(requestType RequestType, err error)              {}
+func (NoopMetrics) Reconnect(hostname string)                                    {}
+func (NoopMetrics) BufferDepth(msgs int)                                         {}
+func (NoopMetrics) ConsumerLag(topic string, partition int, lag uint64)          {}
+
+// latency histogram buckets, in seconds
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+type partitionKey struct {
+	Topic     string
+	Partition int
+}
+
+type PartitionStats struct {
+	Topic       string `json:"topic"`
+	Partition   int    `json:"partition"`
+	MessagesIn  uint64 `json:"messages_in"`
+	BytesIn     uint64 `json:"bytes_in"`
+	MessagesOut uint64 `json:"messages_out"`
+	BytesOut    uint64 `json:"bytes_out"`
+	Lag         uint64 `json:"lag"`
+}
+
+type LatencyStats struct {
+	Count   uint64   `json:"count"`
+	Seconds float64  `json:"seconds"`
+	Max     float64  `json:"max_seconds"`
+	Buckets []uint64 `json:"buckets"` // cumulative counts per latencyBuckets
+}
+
+type CompressionStats struct {
+	RawBytes        uint64  `json:"raw_bytes"`
+	CompressedBytes uint64  `json:"compressed_bytes"`
+	Ratio           float64 `json:"ratio"` // raw / compressed
+}
+
+// a point in time copy of Stats
+type StatsSnapshot struct {
+	Partitions  []PartitionStats             `json:"partitions"`
+	Latency     map[string]*LatencyStats     `json:"latency"`
+	Errors      map[string]uint64            `json:"errors"`
+	Reconnects  map[string]uint64            `json:"reconnects"`
+	BufferDepth int                          `json:"buffer_depth"`
+	Compression map[string]*CompressionStats `json:"compression"`
+}
+
+// Stats is an in memory Metrics implementation, that can be exported through
+// expvar (PublishExpvar) or as prometheus text format (ServeHTTP).
+type Stats struct {
+	mu          sync.Mutex
+	partitions  map[partitionKey]*PartitionStats
+	latency     map[RequestType]*LatencyStats
+	errors      map[RequestType]uint64
+	reconnects  map[string]uint64
+	bufferDepth int
+	compression map[string]*CompressionStats
+}
+
+func NewStats() *Stats {
+	return &Stats{
+		partitions:  make(map[partitionKey]*PartitionStats),
+		latency:     make(map[RequestType]*LatencyStats),
+		errors:      make(map[RequestType]uint64),
+		reconnects:  make(map[string]uint64),
+		compression: make(map[string]*CompressionStats),
+	}
+}
+
+// must hold the lock
+func (s *Stats) partition(topic string, partition int) *PartitionStats {
+	key := partitionKey{topic, partition}
+	ps, ok := s.partitions[key]
+	if !ok {
+		ps = &PartitionStats{Topic: topic, Partition: partition}
+		s.partitions[key] = ps
+	}
+	return ps
+}
+
+func (s *Stats) MessagesIn(topic string, partition int, msgs int, bytes int) {
+	s.mu.Lock()
+	ps := s.partition(topic, partition)
+	ps.MessagesIn += uint64(msgs)
+	ps.BytesIn += uint64(bytes)
+	s.mu.Unlock()
+}
+
+func (s *Stats) MessagesOut(topic string, partition int, msgs int, bytes int) {
+	s.mu.Lock()
+	ps := s.partition(topic, partition)
+	ps.MessagesOut += uint64(msgs)
+	ps.BytesOut += uint64(bytes)
+	s.mu.Unlock()
+}
+
+func (s *Stats) RequestLatency(requestType RequestType, d time.Duration) {
+	secs := d.Seconds()
+	s.mu.Lock()
+	ls, ok := s.latency[requestType]
+	if !ok {
+		ls = &LatencyStats{Buckets: make([]uint64, len(latencyBuckets))}
+		s.latency[requestType] = ls
+	}
+	ls.Count++
+	ls.Seconds += secs
+	if secs > ls.Max {
+		ls.Max = secs
+	}
+	for i, le := range latencyBuckets {
+		if secs <= le {
+			ls.Buckets[i]++
+		}
+	}
+	s.mu.Unlock()
+}
+
+func (s *Stats) RequestError(requestType RequestType, err error) {
+	s.mu.Lock()
+	s.errors[requestType]++
+	s.mu.Unlock()
+}
+
+func (s *Stats) Reconnect(hostname string) {
+	s.mu.Lock()
+	s.reconnects[hostname]++
+	s.mu.Unlock()
+}
+
+func (s *Stats) BufferDepth(msgs int) {
+	s.mu.Lock()
+	s.bufferDepth = msgs
+	s.mu.Unlock()
+}
+
+func (s *Stats) ConsumerLag(topic string, partition int, lag uint64) {
+	s.mu.Lock()
+	s.partition(topic, partition).Lag = lag
+	s.mu.Unlock()
+}
+
+func (s *Stats) Compression(topic string, rawBytes int, compressedBytes int) {
+	s.mu.Lock()
+	cs, ok := s.compression[topic]
+	if !ok {
+		cs = &CompressionStats{}
+		s.compression[topic] = cs
+	}
+	cs.RawBytes += uint64(rawBytes)
+	cs.CompressedBytes += uint64(compressedBytes)
+	s.mu.Unlock()
+}
+
+func (s *Stats) Snapshot() *StatsSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snap := &StatsSnapshot{
+		Partitions:  make([]PartitionStats, 0, len(s.partitions)),
+		Latency:     make(map[string]*LatencyStats, len(s.latency)),
+		Errors:      make(map[string]uint64, len(s.errors)),
+		Reconnects:  make(map[string]uint64, len(s.reconnects)),
+		BufferDepth: s.bufferDepth,
+		Compression: make(map[string]*CompressionStats, len(s.compression)),
+	}
+	for _, ps := range s.partitions {
+		snap.Partitions = append(snap.Partitions, *ps)
+	}
+	sort.Sort(byTopicPartition(snap.Partitions))
+	for rt, ls := range s.latency {
+		lsCopy := *ls
+		lsCopy.Buckets = append([]uint64{}, ls.Buckets...)
+		snap.Latency[rt.String()] = &lsCopy
+	}
+	for rt, ct := range s.errors {
+		snap.Errors[rt.String()] = ct
+	}
+	for host, ct := range s.reconnects {
+		snap.Reconnects[host] = ct
+	}
+	for topic, cs := range s.compression {
+		csCopy := *cs
+		if cs.CompressedBytes > 0 {
+			csCopy.Ratio = float64(cs.RawBytes) / float64(cs.CompressedBytes)
+		}
+		snap.Compression[topic] = &csCopy
+	}
+	return snap
+}
+
+// publish the stats as an expvar variable, which is served on /debug/vars
+func (s *Stats) PublishExpvar(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return s.Snapshot()
+	}))
+}
+
+func (s *Stats) String() string {
+	b, _ := json.Marshal(s.Snapshot())
+	return string(b)
+}
+
+// serves the stats in the prometheus text exposition format
+func (s *Stats) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	s.WritePrometheus(w)
+}
+
+// write the stats in the prometheus text exposition format
+func (s *Stats) WritePrometheus(w io.Writer) {
+	snap := s.Snapshot()
+
+	partitionMetric := func(name, help, kind string, value func(*PartitionStats) uint64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		for i := range snap.Partitions {
+			ps := &snap.Partitions[i]
+			fmt.Fprintf(w, "%s{topic=%q,partition=\"%d\"} %d\n", name, ps.Topic, ps.Partition, value(ps))
+		}
+	}
+	partitionMetric("kafka_messages_in_total", "Messages consumed.", "counter",
+		func(ps *PartitionStats) uint64 { return ps.MessagesIn })
+	partitionMetric("kafka_bytes_in_total", "Bytes consumed.", "counter",
+		func(ps *PartitionStats) uint64 { return ps.BytesIn })
+	partitionMetric("kafka_messages_out_total", "Messages produced.", "counter",
+		func(ps *PartitionStats) uint64 { return ps.MessagesOut })
+	partitionMetric("kafka_bytes_out_total", "Bytes produced.", "counter",
+		func(ps *PartitionStats) uint64 { return ps.BytesOut })
+	partitionMetric("kafka_consumer_lag_bytes", "Bytes between the consumer offset and the latest offset.", "gauge",
+		func(ps *PartitionStats) uint64 { return ps.Lag })
+
+	fmt.Fprint(w, "# HELP kafka_request_latency_seconds Broker request round trip time.\n")
+	fmt.Fprint(w, "# TYPE kafka_request_latency_seconds histogram\n")
+	latencyKeys := make([]string, 0, len(snap.Latency))
+	for rt := range snap.Latency {
+		latencyKeys = append(latencyKeys, rt)
+	}
+	sort.Strings(latencyKeys)
+	for _, rt := range latencyKeys {
+		ls := snap.Latency[rt]
+		for i, le := range latencyBuckets {
+			fmt.Fprintf(w, "kafka_request_latency_seconds_bucket{request=%q,le=\"%g\"} %d\n", rt, le, ls.Buckets[i])
+		}
+		fmt.Fprintf(w, "kafka_request_latency_seconds_bucket{request=%q,le=\"+Inf\"} %d\n", rt, ls.Count)
+		fmt.Fprintf(w, "kafka_request_latency_seconds_sum{request=%q} %g\n", rt, ls.Seconds)
+		fmt.Fprintf(w, "kafka_request_latency_seconds_count{request=%q} %d\n", rt, ls.Count)
+	}
+
+	fmt.Fprint(w, "# HELP kafka_request_errors_total Failed broker requests.\n")
+	fmt.Fprint(w, "# TYPE kafka_request_errors_total counter\n")
+	for _, rt := range sortedKeys(snap.Errors) {
+		fmt.Fprintf(w, "kafka_request_errors_total{request=%q} %d\n", rt, snap.Errors[rt])
+	}
+
+	fmt.Fprint(w, "# HELP kafka_reconnects_total Broker reconnects.\n")
+	fmt.Fprint(w, "# TYPE kafka_reconnects_total counter\n")
+	for _, host := range sortedKeys(snap.Reconnects) {
+		fmt.Fprintf(w, "kafka_reconnects_total{broker=%q} %d\n", host, snap.Reconnects[host])
+	}
+
+	fmt.Fprint(w, "# HELP kafka_producer_buffer_depth Messages waiting in the producer buffer.\n")
+	fmt.Fprint(w, "# TYPE kafka_producer_buffer_depth gauge\n")
+	fmt.Fprintf(w, "kafka_producer_buffer_depth %d\n", snap.BufferDepth)
+
+	compressionTopics := make([]string, 0, len(snap.Compression))
+	for topic := range snap.Compression {
+		compressionTopics = append(compressionTopics, topic)
+	}
+	sort.Strings(compressionTopics)
+	compressionMetric := func(name, help, kind string, value func(*CompressionStats) string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		for _, topic := range compressionTopics {
+			fmt.Fprintf(w, "%s{topic=%q} %s\n", name, topic, value(snap.Compression[topic]))
+		}
+	}
+	compressionMetric("kafka_producer_uncompressed_bytes_total", "Bytes produced before compression.", "counter",
+		func(cs *CompressionStats) string { return fmt.Sprint(cs.RawBytes) })
+	compressionMetric("kafka_producer_compressed_bytes_total", "Bytes produced after compression.", "counter",
+		func(cs *CompressionStats) string { return fmt.Sprint(cs.CompressedBytes) })
+	compressionMetric("kafka_producer_compression_ratio", "Uncompressed / compressed bytes produced.", "gauge",
+		func(cs *CompressionStats) string { return fmt.Sprintf("%g", cs.Ratio) })
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type byTopicPartition []PartitionStats
+
+func (p byTopicPartition) Len() int      { return len(p) }
+func (p byTopicPartition) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p byTopicPartition) Less(i, j int) bool {
+	if p[i].Topic != p[j].Topic {
+		return p[i].Topic < p[j].Topic
+	}
+	return p[i].Partition < p[j].Partition
+}
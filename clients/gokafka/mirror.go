@@ -0,0 +1,318 @@
+/*
+ *  Copyright (c) 2011 NeuStar, Inc.
+ *  All rights reserved.
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  NeuStar, the Neustar logo and related names and logos are registered
+ *  trademarks, service marks or tradenames of NeuStar, Inc. All other
+ *  product names, company names, marks, logos and symbols may be trademarks
+ *  of their respective owners.
+ */
+
+package kafka
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// a broker to mirror from, and the topic/partitions to consume on it
+type MirrorSource struct {
+	Hostname string
+	Topics   []*TopicPartition
+}
+
+// Mirror consumes topics from one or more source brokers and republishes them
+// to a target broker, checkpointing source offsets only once a batch is sent
+type Mirror struct {
+	Sources []*MirrorSource
+	target  *Broker
+
+	// rename topics on the target, topics not in the map keep their source name
+	TopicMap map[string]string
+
+	// only topics the filter returns true for are mirrored, nil mirrors all of them
+	Filter func(topic string) bool
+
+	// re-compress each batch with this codec, nil preserves the codec the
+	// messages were compressed with on the source
+	Codec PayloadCodec
+
+	// publish to the source partition instead of using the target partitioner
+	PreservePartitions bool
+
+	// file to checkpoint source offsets to after each batch is sent, so a
+	// restarted mirror continues without gaps
+	CheckpointFile string
+
+	PollTimeoutMs int64
+	// messages from a source are sent in one produce request once there are
+	// BufferMaxSize of them, or the oldest is BufferMaxMs old
+	BufferMaxMs   int64
+	BufferMaxSize int
+	Logger        Logger
+
+	// guards conn, the connection to the target shared by all sources
+	sendMu sync.Mutex
+	conn   *net.TCPConn
+}
+
+// Create a mirror publishing to target, a broker created with NewRandomPartitionedBroker
+// or NewProducer's partitioner is used to choose the target partition
+func NewMirror(target *Broker, sources ...*MirrorSource) *Mirror {
+	return &Mirror{
+		Sources:       sources,
+		target:        target,
+		TopicMap:      make(map[string]string),
+		PollTimeoutMs: 1000,
+		BufferMaxMs:   1000,
+		BufferMaxSize: 1000,
+		Logger:        NoopLogger{},
+	}
+}
+
+func (m *Mirror) targetTopic(topic string) string {
+	if renamed, ok := m.TopicMap[topic]; ok {
+		return renamed
+	}
+	return topic
+}
+
+// Run the mirror, blocking until quit receives
+func (m *Mirror) Run(quit chan bool) error {
+
+	var checkpoint *OffsetCheckpoint
+	var err error
+	if len(m.CheckpointFile) > 0 {
+		if checkpoint, err = LoadOffsetCheckpoint(m.CheckpointFile); err != nil {
+			return err
+		}
+	}
+
+	defer func() {
+		m.sendMu.Lock()
+		if m.conn != nil {
+			m.conn.Close()
+			m.conn = nil
+		}
+		m.sendMu.Unlock()
+	}()
+
+	stop := make(chan bool)
+	wg := new(sync.WaitGroup)
+	for _, src := range m.Sources {
+		tplist := make([]*TopicPartition, 0, len(src.Topics))
+		for _, tp := range src.Topics {
+			if m.Filter != nil && !m.Filter(tp.Topic) {
+				continue
+			}
+			if checkpoint != nil {
+				if offset, ok := checkpoint.Offset(src.Hostname, tp); ok {
+					tp.Offset = offset
+				}
+			}
+			tplist = append(tplist, tp)
+		}
+		if len(tplist) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(hostname string, tplist []*TopicPartition) {
+			defer wg.Done()
+			m.mirrorSource(hostname, tplist, checkpoint, stop)
+		}(src.Hostname, tplist)
+	}
+
+	<-quit
+	close(stop)
+	wg.Wait()
+	return nil
+}
+
+// consume from one source broker until stopped
+func (m *Mirror) mirrorSource(hostname string, tplist []*TopicPartition, checkpoint *OffsetCheckpoint, stop chan bool) {
+
+	consumer := NewMultiConsumer(hostname, tplist)
+	consumer.SetLogger(m.Logger)
+	pollDuration := time.Duration(m.PollTimeoutMs) * time.Millisecond
+	bufferDuration := time.Duration(m.BufferMaxMs) * time.Millisecond
+
+	// the offsets of the messages sent so far, consuming goes back to these if a send fails
+	sent := make([]uint64, len(tplist))
+	for i, tp := range tplist {
+		sent[i] = tp.Offset
+	}
+	var batch map[partitionKey][]*Message
+	var order []partitionKey
+	var batchCt int
+	var batchStart time.Time
+	reset := func() {
+		batch = make(map[partitionKey][]*Message)
+		order = make([]partitionKey, 0)
+		batchCt = 0
+	}
+	reset()
+
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		num, err := consumer.Consume(func(topic string, partition int, msg *Message) {
+			key := partitionKey{topic, partition}
+			if _, ok := batch[key]; !ok {
+				order = append(order, key)
+			}
+			if batchCt == 0 {
+				batchStart = time.Now()
+			}
+			batch[key] = append(batch[key], msg)
+			batchCt++
+		})
+		if err != nil && err != io.EOF {
+			m.Logger.Error("mirror consume failed", "host", hostname, "err", err)
+		}
+
+		if batchCt > 0 && (batchCt >= m.BufferMaxSize || time.Since(batchStart) >= bufferDuration) {
+			if err = m.send(batch, order, consumer.codecs); err != nil {
+				// consume the batch again, so nothing is skipped
+				m.Logger.Error("mirror send failed, retrying batch", "host", hostname, "messages", batchCt, "err", err)
+				for i, tp := range tplist {
+					tp.Offset = sent[i]
+				}
+				reset()
+				time.Sleep(pollDuration)
+				continue
+			}
+			m.Logger.Debug("mirrored batch", "host", hostname, "messages", batchCt)
+			reset()
+			for i, tp := range tplist {
+				sent[i] = tp.Offset
+			}
+			if checkpoint != nil {
+				checkpoint.Set(hostname, tplist...)
+				if err = checkpoint.Save(); err != nil {
+					m.Logger.Error("could not save checkpoint", "file", m.CheckpointFile, "err", err)
+				}
+			}
+		}
+		if num <= 0 {
+			time.Sleep(pollDuration)
+		}
+	}
+}
+
+// send a batch in one produce request, returning once it is written to the target
+// or failed to be.  0.7 brokers do not acknowledge produce requests, so a written
+// request is as far as the mirror can know the messages were sent
+func (m *Mirror) send(batch map[partitionKey][]*Message, order []partitionKey, codecs map[byte]PayloadCodec) error {
+	m.sendMu.Lock()
+	defer m.sendMu.Unlock()
+
+	preq := make(ProduceRequest)
+	for _, key := range order {
+		partition := key.Partition
+		if !m.PreservePartitions {
+			partition = m.target.Partitioner(m.target)
+		}
+		msgs := make([]*MessageTopic, 0, len(batch[key]))
+		topic := m.targetTopic(key.Topic)
+		for _, msg := range m.wrap(batch[key], codecs) {
+			msgs = append(msgs, &MessageTopic{Topic: topic, Partition: partition, Message: msg})
+		}
+		preq.add(topic, partition, msgs)
+	}
+
+	wire, rejected, err := m.target.wireRequest(preq)
+	if len(rejected) > 0 {
+		return err
+	}
+	request := m.target.EncodeMultiProduceRequest(&wire)
+	start := time.Now()
+	for attempt := 0; attempt < 2; attempt++ {
+		if m.conn == nil {
+			if m.conn, err = m.target.connect(); err != nil {
+				m.conn = nil
+				break
+			}
+			if attempt > 0 {
+				m.target.Metrics.Reconnect(m.target.hostname)
+			}
+		}
+		m.target.extendDeadline(m.conn)
+		if _, err = m.conn.Write(request); err == nil {
+			break
+		}
+		// the connection may have been closed by the broker, reconnect and try once more
+		m.conn.Close()
+		m.conn = nil
+	}
+	if err != nil {
+		m.target.Metrics.RequestError(REQUEST_MULTIPRODUCE, err)
+		return err
+	}
+	m.target.Metrics.RequestLatency(REQUEST_MULTIPRODUCE, time.Since(start))
+	for topic, partMsgs := range wire {
+		for partition, msgs := range partMsgs {
+			bytesOut := 0
+			for _, msg := range msgs {
+				bytesOut += int(msg.Message.TotalLen())
+			}
+			m.target.Metrics.MessagesOut(topic, partition, len(preq[topic][partition]), bytesOut)
+		}
+	}
+	return nil
+}
+
+// wrap the messages of one source topic/partition for publishing, compressing
+// runs of messages into a single message with the configured or source codec
+func (m *Mirror) wrap(msgs []*Message, codecs map[byte]PayloadCodec) []*Message {
+	wrapped := make([]*Message, 0, len(msgs))
+	var run []*Message
+	var runCodec byte
+
+	flush := func() {
+		if len(run) == 0 {
+			return
+		}
+		codec, ok := codecs[runCodec]
+		if m.Codec != nil {
+			codec, ok = m.Codec, true
+		}
+		if !ok || codec.Id() == NO_COMPRESSION_ID {
+			wrapped = append(wrapped, run...)
+		} else {
+			wrapped = append(wrapped, NewCompressedMessagesWithCodec(codec, run...))
+		}
+		run = nil
+	}
+
+	for _, msg := range msgs {
+		if msg == nil {
+			continue
+		}
+		if m.Codec == nil && msg.Codec() != runCodec {
+			flush()
+			runCodec = msg.Codec()
+		}
+		// re-create the message, so older (magic 0) messages are published in the current format
+		run = append(run, NewMessage(msg.Payload()))
+	}
+	flush()
+	return wrapped
+}
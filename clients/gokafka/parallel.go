@@ -0,0 +1,254 @@
+/*
+ *  Copyright (c) 2011 NeuStar, Inc.
+ *  All rights reserved.
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  NeuStar, the Neustar logo and related names and logos are registered
+ *  trademarks, service marks or tradenames of NeuStar, Inc. All other
+ *  product names, company names, marks, logos and symbols may be trademarks
+ *  of their respective owners.
+ */
+
+package kafka
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// ParallelConsumer runs the handler for the partitions of a multi topic/partition consumer
+// on a pool of workers.  Each partition is handled by one worker, so messages of a
+// partition are handled in order, while partitions on different workers are handled
+// concurrently.  Dispatching a fetch never waits for a worker, partitions with maxQueued
+// messages waiting for their worker are left out of fetches until the worker catches up,
+// without changing whether the caller paused them
+type ParallelConsumer struct {
+	consumer      *BrokerConsumer
+	handler       func(*MessageAndMetadata)
+	maxQueued     int
+	PollTimeoutMs int64
+
+	mu         sync.Mutex
+	partitions map[partitionKey]*partitionState
+	// the messages waiting for each worker, wake signals a worker there are more
+	queues  [][]*parallelItem
+	wake    []chan bool
+	closing bool
+	wg      sync.WaitGroup
+}
+
+// the messages of a partition waiting for, or being handled by, its worker
+type partitionState struct {
+	worker    int
+	queued    int
+	inflight  []*parallelItem
+	committed uint64
+	// left out of fetches while the worker catches up
+	held bool
+}
+
+type parallelItem struct {
+	mm    *MessageAndMetadata
+	state *partitionState
+	done  bool
+}
+
+// Create a parallel consumer handling the consumers partitions on up to workers goroutines,
+// fetching a partition stops while maxQueued of its messages are waiting to be handled
+func NewParallelConsumer(consumer *BrokerConsumer, workers int, maxQueued int, handler func(*MessageAndMetadata)) *ParallelConsumer {
+	if workers < 1 {
+		workers = 1
+	}
+	if maxQueued < 1 {
+		maxQueued = 1
+	}
+	pc := &ParallelConsumer{
+		consumer:      consumer,
+		handler:       handler,
+		maxQueued:     maxQueued,
+		PollTimeoutMs: 100,
+		partitions:    make(map[partitionKey]*partitionState),
+		queues:        make([][]*parallelItem, workers),
+		wake:          make([]chan bool, workers),
+	}
+	for i := range pc.wake {
+		pc.wake[i] = make(chan bool, 1)
+	}
+	for _, tp := range consumer.broker.assignedTopics() {
+		pc.state(tp.Topic, tp.Partition, pc.consumer.broker.offset(tp))
+	}
+	return pc
+}
+
+// Fetch and handle messages until quit, then wait for the queued messages to be handled.
+// Partitions held back while their workers caught up are fetched again.  Returns the
+// number of messages handled, and the error of the last fetch
+func (pc *ParallelConsumer) Run(quit chan bool) (int, error) {
+	num := 0
+	var numMu sync.Mutex
+	for worker := range pc.queues {
+		pc.wg.Add(1)
+		go func(worker int) {
+			defer pc.wg.Done()
+			for {
+				items, closing := pc.next(worker)
+				for _, item := range items {
+					pc.handler(item.mm)
+					pc.complete(item)
+				}
+				numMu.Lock()
+				num += len(items)
+				numMu.Unlock()
+				if len(items) == 0 {
+					if closing {
+						return
+					}
+					<-pc.wake[worker]
+				}
+			}
+		}(worker)
+	}
+
+	var err error
+	pollTimeout := time.Duration(pc.PollTimeoutMs) * time.Millisecond
+	for running := true; running; {
+		select {
+		case <-quit:
+			running = false
+			continue
+		default:
+		}
+
+		pc.holdBehind()
+		var fetched int
+		fetched, err = pc.consumer.fetch(pc.dispatch)
+		if err != nil && err != io.EOF {
+			pc.consumer.broker.Logger.Warn("parallel fetch failed", "host", pc.consumer.broker.hostname, "err", err)
+		}
+		if fetched <= 0 {
+			select {
+			case <-quit:
+				running = false
+			case <-time.After(pollTimeout):
+			}
+		}
+	}
+
+	pc.mu.Lock()
+	pc.closing = true
+	pc.mu.Unlock()
+	for worker := range pc.wake {
+		pc.signal(worker)
+	}
+	pc.wg.Wait()
+	pc.releaseAll()
+	if err == io.EOF {
+		err = nil
+	}
+	return num, err
+}
+
+// the state of a partition, created for partitions assigned after the parallel consumer,
+// callers hold mu
+func (pc *ParallelConsumer) state(topic string, partition int, offset uint64) *partitionState {
+	key := partitionKey{topic, partition}
+	state := pc.partitions[key]
+	if state == nil {
+		state = &partitionState{worker: len(pc.partitions) % len(pc.queues), committed: offset}
+		pc.partitions[key] = state
+	}
+	return state
+}
+
+// hold back the partitions whose worker queue is full, and fetch the ones that have caught
+// up again
+func (pc *ParallelConsumer) holdBehind() {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	for _, tp := range pc.consumer.broker.assignedTopics() {
+		state := pc.state(tp.Topic, tp.Partition, pc.consumer.broker.offset(tp))
+		if behind := state.queued >= pc.maxQueued; behind != state.held {
+			pc.consumer.hold(tp.Topic, tp.Partition, behind)
+			state.held = behind
+		}
+	}
+}
+
+// fetch the partitions held back by holdBehind again
+func (pc *ParallelConsumer) releaseAll() {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	for key, state := range pc.partitions {
+		if state.held {
+			pc.consumer.hold(key.Topic, key.Partition, false)
+			state.held = false
+		}
+	}
+}
+
+// queue a message for its partitions worker, without waiting for the worker
+func (pc *ParallelConsumer) dispatch(mm *MessageAndMetadata) {
+	pc.mu.Lock()
+	state := pc.state(mm.Topic, mm.Partition, mm.Offset)
+	item := &parallelItem{mm: mm, state: state}
+	state.queued++
+	state.inflight = append(state.inflight, item)
+	pc.queues[state.worker] = append(pc.queues[state.worker], item)
+	pc.mu.Unlock()
+	pc.signal(state.worker)
+}
+
+func (pc *ParallelConsumer) signal(worker int) {
+	select {
+	case pc.wake[worker] <- true:
+	default:
+	}
+}
+
+// the messages queued for a worker, and whether Run is stopping
+func (pc *ParallelConsumer) next(worker int) ([]*parallelItem, bool) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	items := pc.queues[worker]
+	pc.queues[worker] = nil
+	return items, pc.closing
+}
+
+// mark a message handled, and move the partitions committed offset past every handled
+// message before it
+func (pc *ParallelConsumer) complete(item *parallelItem) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	item.done = true
+	state := item.state
+	state.queued--
+	for len(state.inflight) > 0 && state.inflight[0].done {
+		state.committed = state.inflight[0].mm.NextOffset
+		state.inflight = state.inflight[1:]
+	}
+}
+
+// The offset of each partition that is safe to commit, every message before it has been handled
+func (pc *ParallelConsumer) Committed() []*TopicPartition {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	committed := make([]*TopicPartition, 0, len(pc.partitions))
+	for _, tp := range pc.consumer.broker.assignedTopics() {
+		state := pc.state(tp.Topic, tp.Partition, pc.consumer.broker.offset(tp))
+		committed = append(committed, &TopicPartition{Topic: tp.Topic, Partition: tp.Partition,
+			Offset: state.committed, MaxSize: tp.MaxSize})
+	}
+	return committed
+}
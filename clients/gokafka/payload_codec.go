@@ -98,13 +98,18 @@ func (codec *GzipPayloadCodec) Encode(data []byte) []byte {
 
 func (codec *GzipPayloadCodec) Decode(data []byte) []byte {
 	buf := bytes.NewBuffer([]byte{})
-	zipper, _ := gzip.NewReader(bytes.NewBuffer(data))
+	zipper, err := gzip.NewReader(bytes.NewBuffer(data))
+	if err != nil {
+		return buf.Bytes()
+	}
 	unzipped := make([]byte, 100)
 	for {
 		n, err := zipper.Read(unzipped)
-		if n > 0 && err == nil {
+		// the last read can return data along with io.EOF
+		if n > 0 {
 			buf.Write(unzipped[0:n])
-		} else {
+		}
+		if err != nil {
 			break
 		}
 	}
@@ -23,7 +23,6 @@
 package kafka
 
 import (
-	"log"
 	"net"
 	"strings"
 	"sync"
@@ -35,9 +34,49 @@ type MessageSender func(msg *MessageTopic)
 // an interface for a partitioner that chooses from available partitions
 type Partitioner func(*Broker) int
 
+// called with the messages of a buffered produce request that could not be sent
+type SendErrorHandler func(msgs []*MessageTopic, err error)
+
 // a produce request with multiple partitions
 type ProduceRequest map[string]map[int][]*MessageTopic
 
+// add msgs to the topic/partition, if there are any
+func (p ProduceRequest) add(topic string, partition int, msgs []*MessageTopic) {
+	if len(msgs) == 0 {
+		return
+	}
+	if _, ok := p[topic]; !ok {
+		p[topic] = make(map[int][]*MessageTopic)
+	}
+	p[topic][partition] = append(p[topic][partition], msgs...)
+}
+
+// all of the messages in the request
+func (p ProduceRequest) messages() []*MessageTopic {
+	msgs := make([]*MessageTopic, 0)
+	for _, partMsgs := range p {
+		for _, messages := range partMsgs {
+			msgs = append(msgs, messages...)
+		}
+	}
+	return msgs
+}
+
+// the messages in the request that are not in other
+func (p ProduceRequest) without(other ProduceRequest) []*MessageTopic {
+	exclude := make(map[*MessageTopic]bool)
+	for _, msg := range other.messages() {
+		exclude[msg] = true
+	}
+	msgs := make([]*MessageTopic, 0)
+	for _, msg := range p.messages() {
+		if !exclude[msg] {
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs
+}
+
 // does this ProduceRequest contain more than one topic/partition combo?
 func (p ProduceRequest) MultiPart() bool {
 	if len(p) > 1 {
@@ -69,6 +108,10 @@ func (p ProduceRequest) TopicPartCt() (ct int) {
 
 type BrokerPublisher struct {
 	broker *Broker
+	// set by SetAsync, Publish buffers messages in the sender until Close
+	sender     MessageSender
+	stopSender chan bool
+	senderDone chan bool
 }
 
 func NewBrokerPublisher(hostname string, topic string, partition int) *BrokerPublisher {
@@ -87,26 +130,136 @@ func NewPartitionedProducer(hostname string, topic string, partitions []int) *Br
 	return &BrokerPublisher{broker: b}
 }
 
+// Set the Metrics implementation that receives this publishers statistics, nil discards them
+func (b *BrokerPublisher) SetMetrics(metrics Metrics) {
+	if metrics == nil {
+		metrics = NoopMetrics{}
+	}
+	b.broker.Metrics = metrics
+}
+
+// Set the Logger for this publisher, the default discards all output
+func (b *BrokerPublisher) SetLogger(logger Logger) {
+	if logger == nil {
+		logger = NoopLogger{}
+	}
+	b.broker.Logger = logger
+}
+
+// Set the timeout connecting to the broker and for each request, and the socket buffer size.
+// 0 waits forever or keeps the system default
+func (b *BrokerPublisher) SetSocketOptions(connectTimeout, socketTimeout time.Duration, bufferSize int) {
+	b.broker.ConnectTimeout = connectTimeout
+	b.broker.SocketTimeout = socketTimeout
+	b.broker.SocketBufferSize = bufferSize
+}
+
+// Publish asynchronously like the scala async producer: Publish and BatchPublish buffer
+// the messages, which are sent bufferMaxSize at a time or every bufferMaxMs, until Close.
+// Messages that can't be sent go to the SendErrorHandler of the broker
+func (b *BrokerPublisher) SetAsync(bufferMaxMs int64, bufferMaxSize int) error {
+	if b.sender != nil {
+		return nil
+	}
+	stopSender := make(chan bool)
+	sender, senderDone, err := NewBufferedSenderWithQuit(b.broker, bufferMaxMs, bufferMaxSize, stopSender)
+	if err != nil {
+		return err
+	}
+	b.sender, b.stopSender, b.senderDone = sender, stopSender, senderDone
+	return nil
+}
+
+// Send the messages buffered by an async publisher and stop it, the publisher must not
+// be used after.  Does nothing for a sync publisher
+func (b *BrokerPublisher) Close() {
+	if b.sender == nil {
+		return
+	}
+	close(b.stopSender)
+	<-b.senderDone
+	b.sender = nil
+}
+
+// Limit the rate messages and bytes are published at, sends block until they are under the limits
+func (b *BrokerPublisher) SetThrottle(throttle *Throttler) {
+	b.broker.Throttle = throttle
+}
+
+// Compress the messages sent by Publish, BatchPublish and PublishOnChannel per topic,
+// see NewCompressionPolicy
+func (b *BrokerPublisher) SetCompression(policy CompressionPolicy) {
+	b.broker.Compression = policy
+}
+
+// Reject messages and compressed batches with a payload over maxSize bytes, with a
+// MessageSizeTooLargeError.  If split is true compressed batches are split into smaller
+// batches instead
+func (b *BrokerPublisher) SetMaxMessageSize(maxSize int, split bool) {
+	b.broker.MaxMessageSize = maxSize
+	b.broker.SplitLargeBatches = split
+}
+
 func (b *BrokerPublisher) Publish(message *Message) (int, error) {
 	return b.BatchPublish(message)
 }
 
+// Publish messages, compressed by the compression policy, returning a
+// MessageSizeTooLargeError without sending any of them if one is over the max message size.
+// An async publisher buffers them and returns 0, see SetAsync
 func (b *BrokerPublisher) BatchPublish(messages ...*Message) (int, error) {
+	tp := b.broker.topics[0]
+	if b.sender != nil {
+		for _, msg := range messages {
+			b.sender(&MessageTopic{Topic: tp.Topic, Partition: -1, Message: msg})
+		}
+		return 0, nil
+	}
+	msgs := make([]*MessageTopic, len(messages))
+	for i, msg := range messages {
+		msgs[i] = &MessageTopic{Topic: tp.Topic, Partition: tp.Partition, Message: msg}
+	}
+	wire, rejected, err := b.broker.wireRequest(ProduceRequest{tp.Topic: {tp.Partition: msgs}})
+	if len(rejected) > 0 {
+		return -1, err
+	}
+	sent := len(messages)
+	messages = make([]*Message, 0, len(messages))
+	for _, msg := range wire[tp.Topic][tp.Partition] {
+		messages = append(messages, msg.Message)
+	}
+
 	conn, err := b.broker.connect()
 	if err != nil {
 		return -1, err
 	}
 	defer conn.Close()
 
+	bytesOut := 0
+	for _, msg := range messages {
+		bytesOut += int(msg.TotalLen())
+	}
+	b.broker.Throttle.Wait(sent, bytesOut)
+
 	request := b.broker.EncodeProduceRequest(messages...)
+	start := time.Now()
 	num, err := conn.Write(request)
 	if err != nil {
+		b.broker.Metrics.RequestError(REQUEST_PRODUCE, err)
 		return -1, err
 	}
+	b.broker.Metrics.RequestLatency(REQUEST_PRODUCE, time.Since(start))
+
+	b.broker.Metrics.MessagesOut(tp.Topic, tp.Partition, sent, bytesOut)
 
 	return num, err
 }
 
+// Add interceptors that see the messages sent by the buffered sender, after any already added
+func (b *BrokerPublisher) AddInterceptors(interceptors ...ProducerInterceptor) {
+	b.broker.ProducerInterceptors = append(b.broker.ProducerInterceptors, interceptors...)
+}
+
 // opens a channel for publishing, blocking call
 func (b *BrokerPublisher) PublishOnChannel(msgChan chan *MessageTopic, bufferMaxMs int64, bufferMaxSize int, quit chan bool) error {
 
@@ -136,11 +289,25 @@ func (b *BrokerPublisher) PublishOnChannel(msgChan chan *MessageTopic, bufferMax
 // Buffered Sender, buffers messages for max time, and max size
 // uses a partitioner to choose partition
 func NewBufferedSender(broker *Broker, bufferMaxMs int64, bufferMaxSize int) (MessageSender, *net.TCPConn, error) {
+	sender, conn, _, err := newBufferedSender(broker, bufferMaxMs, bufferMaxSize, nil)
+	return sender, conn, err
+}
+
+// Like NewBufferedSender, but stops when quit is closed: the buffered messages are sent,
+// sends in progress are waited for, and the senders connection, whichever it reconnected
+// to, is closed.  done is closed once the sender has stopped, nothing may be sent after
+// closing quit
+func NewBufferedSenderWithQuit(broker *Broker, bufferMaxMs int64, bufferMaxSize int, quit chan bool) (sender MessageSender, done chan bool, err error) {
+	sender, _, done, err = newBufferedSender(broker, bufferMaxMs, bufferMaxSize, quit)
+	return sender, done, err
+}
+
+func newBufferedSender(broker *Broker, bufferMaxMs int64, bufferMaxSize int, quit chan bool) (MessageSender, *net.TCPConn, chan bool, error) {
 
 	conn, connErr := broker.connect()
 	if connErr != nil {
 		// We are not returning, as we will keep trying to connect
-		log.Println("FATAL ERROR, could not connect ", connErr)
+		broker.Logger.Error("could not connect, will retry on send", "host", broker.hostname, "err", connErr)
 		//return nil, nil, connErr
 	}
 
@@ -152,6 +319,10 @@ func NewBufferedSender(broker *Broker, bufferMaxMs int64, bufferMaxSize int) (Me
 		defaultTopic = broker.topics[0].Topic
 	}
 	msgMu := new(sync.Mutex)
+	// one request at a time on conn, which a failed send replaces
+	connMu := new(sync.Mutex)
+	var sending sync.WaitGroup
+	done := make(chan bool)
 	timer := time.NewTicker(time.Duration(bufferMaxMs) * time.Millisecond)
 
 	doSend := func(msgBufCopy ProduceRequest) {
@@ -160,9 +331,52 @@ func NewBufferedSender(broker *Broker, bufferMaxMs int64, bufferMaxSize int) (Me
 		msgCt = 0
 		msgBuffer = make(ProduceRequest)
 		msgMu.Unlock()
+		broker.Metrics.BufferDepth(0)
+		connMu.Lock()
+		defer connMu.Unlock()
 		//if msgBufCopy.MultiPart() {
-		request := broker.EncodeMultiProduceRequest(&msgBufCopy)
-		_, err := conn.Write(request)
+		wire, rejected, err := broker.wireRequest(msgBufCopy)
+		if len(rejected) > 0 {
+			tooLarge := rejected.messages()
+			broker.Logger.Error("messages too large", "host", broker.hostname, "messages", len(tooLarge), "err", err)
+			broker.Metrics.RequestError(REQUEST_MULTIPRODUCE, err)
+			if broker.SendErrorHandler != nil {
+				broker.SendErrorHandler(tooLarge, err)
+			}
+			broker.acknowledge(tooLarge, err)
+		}
+		if len(wire) == 0 {
+			return
+		}
+		request := broker.EncodeMultiProduceRequest(&wire)
+		start := time.Now()
+		err = nil
+		if conn == nil {
+			// never connected, or the last reconnect failed
+			if conn, err = broker.connect(); err == nil {
+				broker.Metrics.Reconnect(broker.hostname)
+			}
+		}
+		if err == nil {
+			broker.extendDeadline(conn)
+			_, err = conn.Write(request)
+		}
+		if err == nil {
+			broker.Metrics.RequestLatency(REQUEST_MULTIPRODUCE, time.Since(start))
+			for topic, partMsgs := range msgBufCopy {
+				for partition, messages := range partMsgs {
+					bytesOut := 0
+					for _, msg := range wire[topic][partition] {
+						bytesOut += int(msg.Message.TotalLen())
+					}
+					if sent := len(messages) - len(rejected[topic][partition]); sent > 0 {
+						broker.Metrics.MessagesOut(topic, partition, sent, bytesOut)
+					}
+				}
+			}
+		} else {
+			broker.Metrics.RequestError(REQUEST_MULTIPRODUCE, err)
+		}
 		//} else {
 		//  for _, partMsgs := range msgBufCopy {
 		//    for _, msgs := range partMsgs {
@@ -172,26 +386,51 @@ func NewBufferedSender(broker *Broker, bufferMaxMs int64, bufferMaxSize int) (Me
 		//  }
 		//}
 
+		// the uncompressed messages, which were not already rejected
+		sent := msgBufCopy.without(rejected)
+		if err != nil && broker.SendErrorHandler != nil {
+			broker.SendErrorHandler(sent, err)
+		}
+		broker.acknowledge(sent, err)
+
 		if err != nil {
 			//write tcp 192.168.1.25:9092: broken pipe
 			if strings.Contains(err.Error(), "broken pipe") || strings.Contains(err.Error(), "invalid argument") {
 				// TODO:  Handle buffering and resend?
 				conn, connErr = broker.connect()
 				if connErr != nil {
-					log.Println("ERROR could not reconnect? ", connErr)
+					broker.Logger.Error("could not reconnect", "host", broker.hostname, "err", connErr)
 				} else {
-					log.Println("kafka reconnected ")
+					broker.Metrics.Reconnect(broker.hostname)
+					broker.Logger.Info("reconnected", "host", broker.hostname)
 				}
 			} else {
-				log.Println("ERROR potentially fatal? ", err)
+				broker.Logger.Error("produce request failed", "host", broker.hostname, "err", err)
 			}
 		}
 	}
 
-	log.Println("start buffered sender heartbeat = ", bufferMaxMs, " max queue ", bufferMaxSize)
+	broker.Logger.Info("start buffered sender", "host", broker.hostname, "heartbeat", bufferMaxMs,
+		"maxqueue", bufferMaxSize)
 	go func() {
-
-		for _ = range timer.C {
+		defer timer.Stop()
+		for {
+			select {
+			case <-quit:
+				msgMu.Lock()
+				remaining := msgBuffer
+				msgMu.Unlock()
+				doSend(remaining)
+				sending.Wait()
+				connMu.Lock()
+				if conn != nil {
+					conn.Close()
+				}
+				connMu.Unlock()
+				close(done)
+				return
+			case <-timer.C:
+			}
 			msgMu.Lock()
 			if msgCt > 0 && !hasSent {
 				hasSent = false
@@ -210,6 +449,10 @@ func NewBufferedSender(broker *Broker, bufferMaxMs int64, bufferMaxSize int) (Me
 			doSend(msgBuffer)
 			return
 		}
+		if msg = broker.interceptSend(msg); msg == nil {
+			return
+		}
+		broker.Throttle.Wait(1, int(msg.Message.TotalLen()))
 		msgMu.Lock()
 		msgCt++
 		partId := msg.Partition
@@ -230,13 +473,20 @@ func NewBufferedSender(broker *Broker, bufferMaxMs int64, bufferMaxSize int) (Me
 		}
 
 		msgBuffer[topic][partId] = append(msgBuffer[topic][partId], msg)
+		broker.Metrics.BufferDepth(msgCt)
 		if msgCt > bufferMaxSize {
 			hasSent = true
+			full := msgBuffer
+			sending.Add(1)
 			msgMu.Unlock()
-			go doSend(msgBuffer)
+			go func() {
+				defer sending.Done()
+				doSend(full)
+			}()
 		} else {
 			msgMu.Unlock()
 		}
 
-	}, conn, nil
+	}, conn, done, nil
 }
+
@@ -0,0 +1,141 @@
+/*
+ *  Copyright (c) 2011 NeuStar, Inc.
+ *  All rights reserved.
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  NeuStar, the Neustar logo and related names and logos are registered
+ *  trademarks, service marks or tradenames of NeuStar, Inc. All other
+ *  product names, company names, marks, logos and symbols may be trademarks
+ *  of their respective owners.
+ */
+
+package kafka
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// Replay copies the messages of one topic/partition, between a start and end
+// offset, into an output topic, like the scala ReplayLogProducer
+type Replay struct {
+	Hostname string
+	// the topic/partition to read, Offset is the start offset
+	Source *TopicPartition
+	// stop before this offset, 0 replays up to the end of the log when Run starts
+	EndOffset uint64
+
+	target      *Broker
+	OutputTopic string
+
+	// optionally transform each payload before it is published, returning nil
+	// skips the message
+	Transform func(payload []byte) []byte
+
+	// max messages and bytes published per second, 0 is unlimited
+	MessagesPerSec int
+	BytesPerSec    int
+
+	PollTimeoutMs int64
+	BufferMaxMs   int64
+	BufferMaxSize int
+	Logger        Logger
+}
+
+// Create a replay of source (starting at source.Offset) on hostname into outputTopic on target
+func NewReplay(hostname string, source *TopicPartition, target *Broker, outputTopic string) *Replay {
+	return &Replay{
+		Hostname:      hostname,
+		Source:        source,
+		target:        target,
+		OutputTopic:   outputTopic,
+		PollTimeoutMs: 1000,
+		BufferMaxMs:   1000,
+		BufferMaxSize: 1000,
+		Logger:        NoopLogger{},
+	}
+}
+
+// Get the offset of the last log segment written before t, kafka only tracks
+// time at segment granularity so this is where to start to replay from a time
+func OffsetBefore(hostname string, tp *TopicPartition, t time.Time) (uint64, error) {
+	return GetOffsetBefore(hostname, tp, t.UnixNano()/int64(time.Millisecond))
+}
+
+// Run the replay, blocking until the end offset is reached or quit receives, and the
+// published messages are sent.  Returns the number of messages published
+func (r *Replay) Run(quit chan bool) (int, error) {
+
+	end := r.EndOffset
+	if end == 0 {
+		var err error
+		if end, err = GetOffsetBefore(r.Hostname, r.Source, -1); err != nil {
+			return 0, fmt.Errorf("could not get the end offset of %s-%d: %v", r.Source.Topic, r.Source.Partition, err)
+		}
+	}
+
+	stopSender := make(chan bool)
+	sender, senderDone, err := NewBufferedSenderWithQuit(r.target, r.BufferMaxMs, r.BufferMaxSize, stopSender)
+	if err != nil {
+		return 0, err
+	}
+	// the sender publishes what it has buffered before closing its connection
+	defer func() {
+		close(stopSender)
+		<-senderDone
+	}()
+
+	consumer := NewBrokerConsumer(r.Hostname, r.Source.Topic, r.Source.Partition, r.Source.Offset, r.Source.MaxSize)
+	consumer.SetLogger(r.Logger)
+	tp := consumer.broker.topics[0]
+	throttle := NewThrottler(r.MessagesPerSec, r.BytesPerSec)
+	pollDuration := time.Duration(r.PollTimeoutMs) * time.Millisecond
+	published := 0
+
+	for tp.Offset < end {
+		select {
+		case <-quit:
+			return published, nil
+		default:
+		}
+
+		num, err := consumer.Consume(func(topic string, partition int, msg *Message) {
+			if msg == nil || msg.Offset() >= end {
+				return
+			}
+			payload := msg.Payload()
+			if r.Transform != nil {
+				if payload = r.Transform(payload); payload == nil {
+					return
+				}
+			}
+			out := NewMessage(payload)
+			throttle.Wait(1, int(out.TotalLen()))
+			sender(&MessageTopic{Topic: r.OutputTopic, Partition: -1, Message: out})
+			published++
+		})
+		if err != nil && err != io.EOF {
+			r.Logger.Error("replay consume failed", "host", r.Hostname, "topic", tp.Topic, "partition", tp.Partition,
+				"offset", tp.Offset, "err", err)
+		}
+		if num <= 0 {
+			time.Sleep(pollDuration)
+		}
+		r.Logger.Debug("replayed batch", "topic", tp.Topic, "partition", tp.Partition, "offset", tp.Offset,
+			"end", end, "messages", num)
+	}
+
+	return published, nil
+}
@@ -25,7 +25,6 @@ package kafka
 import (
 	"bytes"
 	"encoding/binary"
-	"log"
 )
 
 type RequestType uint16
@@ -39,6 +38,22 @@ const (
 	REQUEST_OFFSETS                  = 4
 )
 
+func (r RequestType) String() string {
+	switch r {
+	case REQUEST_PRODUCE:
+		return "produce"
+	case REQUEST_FETCH:
+		return "fetch"
+	case REQUEST_MULTIFETCH:
+		return "multifetch"
+	case REQUEST_MULTIPRODUCE:
+		return "multiproduce"
+	case REQUEST_OFFSETS:
+		return "offsets"
+	}
+	return "unknown"
+}
+
 // Request Header: <REQUEST_SIZE: uint32><REQUEST_TYPE: uint16>
 func (b *Broker) EncodeRequestHeader(request *bytes.Buffer, requestType RequestType) {
 	request.Write(uint32bytes(0)) // placeholder for request size
@@ -92,11 +107,13 @@ func (b *Broker) EncodeConsumeRequest() []byte {
 	//if len(b.topics) != 1 {
 	//  return request.Bytes()
 	//}
-	tp := b.topics[0]
+	tp := b.assignedTopics()[0]
 
 	b.EncodeRequestHeader(request, REQUEST_FETCH)
 
+	b.mu.Lock()
 	EncodeTopicFetch(request, tp)
+	b.mu.Unlock()
 
 	encodeRequestSize(request)
 
@@ -129,17 +146,24 @@ func (b *Broker) EncodeConsumeRequestMultiFetch() []byte {
 	    0 0 0 0          <PARTITION: uint32>
 	*/
 
+	return b.encodeMultiFetch(b.fetchTopics())
+}
+
+// multifetch request for tplist, paused topic/partitions are left out by the caller
+func (b *Broker) encodeMultiFetch(tplist []*TopicPartition) []byte {
 	request := bytes.NewBuffer([]byte{})
 	b.EncodeRequestHeader(request, REQUEST_MULTIFETCH)
 
-	request.Write(uint16bytes(len(b.topics)))
+	request.Write(uint16bytes(len(tplist)))
 
-	for _, tp := range b.topics {
+	b.mu.Lock()
+	for _, tp := range tplist {
 		EncodeTopicFetch(request, tp)
 	}
+	b.mu.Unlock()
 
 	encodeRequestSize(request)
-	log.Println(request.Bytes())
+	b.Logger.Debug("multifetch request", "topicpartitions", len(tplist), "request", request.Bytes())
 	return request.Bytes()
 }
 
@@ -0,0 +1,172 @@
+/*
+ *  Copyright (c) 2011 NeuStar, Inc.
+ *  All rights reserved.
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  NeuStar, the Neustar logo and related names and logos are registered
+ *  trademarks, service marks or tradenames of NeuStar, Inc. All other
+ *  product names, company names, marks, logos and symbols may be trademarks
+ *  of their respective owners.
+ */
+
+package kafka
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Handles a message, returning an error if it could not be processed
+type MessageErrorHandlerFunc func(mm *MessageAndMetadata) error
+
+// RetryPolicy retries messages an error returning handler fails on, then republishes
+// them to a dead letter topic wrapped in a DeadLetter, so consuming can continue
+type RetryPolicy struct {
+	// attempts before a message is dead lettered, at least 1.  Publishing the dead
+	// letter is retried as many times
+	MaxAttempts int
+	// wait between attempts, doubling after each one up to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// publishes dead letters.  With nil there is no dead letter topic, the handlers last
+	// error is returned after MaxAttempts so the message isn't committed
+	DeadLetter *BrokerPublisher
+	Logger     Logger
+}
+
+// A message that failed processing, as published to the dead letter topic
+type DeadLetter struct {
+	Topic     string    `json:"topic"`
+	Partition int       `json:"partition"`
+	Offset    uint64    `json:"offset"`
+	Error     string    `json:"error"`
+	Attempts  int       `json:"attempts"`
+	Time      time.Time `json:"time"`
+	Payload   []byte    `json:"payload"`
+}
+
+// Decode a message from a dead letter topic
+func ParseDeadLetter(payload []byte) (*DeadLetter, error) {
+	dl := &DeadLetter{}
+	if err := json.Unmarshal(payload, dl); err != nil {
+		return nil, err
+	}
+	return dl, nil
+}
+
+// Create a retry policy, dead lettering to deadLetter after maxAttempts
+func NewRetryPolicy(maxAttempts int, backoff time.Duration, deadLetter *BrokerPublisher) *RetryPolicy {
+	return &RetryPolicy{MaxAttempts: maxAttempts, Backoff: backoff, MaxBackoff: 30 * time.Second,
+		DeadLetter: deadLetter, Logger: NoopLogger{}}
+}
+
+// Wrap handler with the retry policy, for messages from ConsumeMetadataOnChannel and the
+// ConsumerIterator.  The wrapped handler returns nil once the message is handled or dead
+// lettered, and otherwise the error publishing the dead letter (or the handlers last error
+// without a DeadLetter publisher), the message was neither handled nor kept so it
+// shouldn't be committed
+func (p *RetryPolicy) Handler(handler MessageErrorHandlerFunc) MessageErrorHandlerFunc {
+	return func(mm *MessageAndMetadata) error {
+		return p.handle(handler, mm)
+	}
+}
+
+// Call fn until it succeeds or MaxAttempts is reached, backing off between attempts.
+// Returns the number of attempts and the last error
+func (p *RetryPolicy) retry(fn func() error) (int, error) {
+	maxAttempts := p.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	backoff := p.Backoff
+	var err error
+	attempts := 0
+	for attempts < maxAttempts {
+		if err = fn(); err == nil {
+			return attempts + 1, nil
+		}
+		attempts++
+		if attempts < maxAttempts {
+			time.Sleep(backoff)
+			if backoff *= 2; p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+				backoff = p.MaxBackoff
+			}
+		}
+	}
+	return attempts, err
+}
+
+// Call handler until it succeeds or MaxAttempts is reached, then dead letter the message.
+// Returns the error publishing the dead letter, or the handlers error if there is no
+// DeadLetter publisher
+func (p *RetryPolicy) handle(handler MessageErrorHandlerFunc, mm *MessageAndMetadata) error {
+	attempts, err := p.retry(func() error { return handler(mm) })
+	if err == nil {
+		return nil
+	}
+
+	if p.DeadLetter == nil {
+		p.logger().Error("message failed, no dead letter topic", "topic", mm.Topic, "partition", mm.Partition,
+			"offset", mm.Offset, "attempts", attempts, "err", err)
+		return err
+	}
+	p.logger().Warn("message failed, dead lettering", "topic", mm.Topic, "partition", mm.Partition,
+		"offset", mm.Offset, "attempts", attempts, "err", err)
+	dl := &DeadLetter{Topic: mm.Topic, Partition: mm.Partition, Offset: mm.Offset, Error: err.Error(),
+		Attempts: attempts, Time: time.Now(), Payload: mm.Payload()}
+	payload, jerr := json.Marshal(dl)
+	if jerr != nil {
+		return jerr
+	}
+	if _, err = p.retry(func() error {
+		_, perr := p.DeadLetter.Publish(NewMessage(payload))
+		return perr
+	}); err != nil {
+		p.logger().Error("could not publish dead letter", "topic", mm.Topic, "partition", mm.Partition,
+			"offset", mm.Offset, "err", err)
+	}
+	return err
+}
+
+func (p *RetryPolicy) logger() Logger {
+	if p.Logger == nil {
+		return NoopLogger{}
+	}
+	return p.Logger
+}
+
+// Consume a message set for each topic/partition like Consume, retrying and dead
+// lettering the messages handler fails on with policy.  If a dead letter can't be
+// published, or the policy has no DeadLetter publisher, the rest of the fetch isn't handled, the offsets are rewound to the message
+// set holding the failed message so the next fetch gets it again, and the error is
+// returned with the number of messages handled
+func (consumer *BrokerConsumer) ConsumeWithRetry(handler MessageErrorHandlerFunc, policy *RetryPolicy) (int, error) {
+	committed := consumer.committedOffsets()
+	var dlErr error
+	handled := 0
+	num, err := consumer.fetch(func(mm *MessageAndMetadata) {
+		if dlErr != nil {
+			return
+		}
+		if dlErr = policy.handle(handler, mm); dlErr == nil {
+			committed.commit(newMessageBatch([]*MessageAndMetadata{mm}))
+			handled++
+		}
+	})
+	if dlErr != nil {
+		committed.rewind(consumer.broker)
+		return handled, dlErr
+	}
+	return num, err
+}
@@ -0,0 +1,204 @@
+/*
+ *  Copyright (c) 2011 NeuStar, Inc.
+ *  All rights reserved.
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  NeuStar, the Neustar logo and related names and logos are registered
+ *  trademarks, service marks or tradenames of NeuStar, Inc. All other
+ *  product names, company names, marks, logos and symbols may be trademarks
+ *  of their respective owners.
+ */
+
+// Package segment reads a kafka partition directory offline, walking the
+// <offset>.kafka segment files the broker writes without a running broker
+package segment
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	kafka "github.com/apache/kafka/clients/gokafka"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	FILE_SUFFIX = ".kafka"
+)
+
+var (
+	ErrTruncated = errors.New("truncated message at end of segment")
+	ErrChecksum  = errors.New("checksum mismatch")
+	ErrMagic     = errors.New("unknown magic byte")
+)
+
+// a segment file of a partition, the name is the offset of its first message
+type Segment struct {
+	Path       string
+	BaseOffset uint64
+	Size       int64
+}
+
+// one message (or compressed message set) read from a segment
+type Entry struct {
+	Segment     *Segment
+	Offset      uint64 // offset of the message in the partition log
+	Size        uint32 // length of the message, excluding the 4 byte length field
+	Magic       byte
+	Compression byte
+	Checksum    uint32 // checksum stored with the message
+	Computed    uint32 // checksum of the payload as read
+	Messages    []*kafka.Message
+	Err         error
+}
+
+// the offset of the message following this one
+func (e *Entry) NextOffset() uint64 {
+	return e.Offset + uint64(e.Size) + 4
+}
+
+func (e *Entry) Corrupt() bool {
+	return e.Err != nil
+}
+
+// the file name of the segment starting at offset
+func FileName(offset uint64) string {
+	return fmt.Sprintf("%020d%s", offset, FILE_SUFFIX)
+}
+
+// the segments of a partition directory, ordered by offset
+func Segments(dir string) ([]*Segment, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	segments := make([]*Segment, 0)
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasSuffix(name, FILE_SUFFIX) {
+			continue
+		}
+		baseOffset, err := strconv.ParseUint(strings.TrimSuffix(name, FILE_SUFFIX), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, &Segment{Path: filepath.Join(dir, name), BaseOffset: baseOffset, Size: file.Size()})
+	}
+	sort.Sort(byOffset(segments))
+	return segments, nil
+}
+
+type byOffset []*Segment
+
+func (s byOffset) Len() int           { return len(s) }
+func (s byOffset) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byOffset) Less(i, j int) bool { return s[i].BaseOffset < s[j].BaseOffset }
+
+// a partition directory, such as /tmp/kafka-logs/test-0
+type Partition struct {
+	Dir      string
+	Segments []*Segment
+	Codecs   map[byte]kafka.PayloadCodec
+}
+
+func Open(dir string) (*Partition, error) {
+	segments, err := Segments(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &Partition{Dir: dir, Segments: segments, Codecs: kafka.DefaultCodecsMap}, nil
+}
+
+// Walk every message of every segment in offset order, corrupt messages are passed
+// to fn with Err set.  A truncated message ends its segment, returning an error
+// from fn stops the walk.
+func (p *Partition) Walk(fn func(*Entry) error) error {
+	for _, segment := range p.Segments {
+		if err := p.walkSegment(segment, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Partition) walkSegment(segment *Segment, fn func(*Entry) error) error {
+	file, err := os.Open(segment.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+
+	position := uint64(0)
+	length := make([]byte, 4)
+	for {
+		if _, err = io.ReadFull(reader, length); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fn(&Entry{Segment: segment, Offset: segment.BaseOffset + position, Err: ErrTruncated})
+		}
+		entry := &Entry{Segment: segment, Offset: segment.BaseOffset + position, Size: binary.BigEndian.Uint32(length)}
+		if entry.Size == 0 || int64(position)+4+int64(entry.Size) > segment.Size {
+			// a partial write, the broker died while appending
+			entry.Err = ErrTruncated
+			return fn(entry)
+		}
+		packet := make([]byte, 4+entry.Size)
+		copy(packet, length)
+		if _, err = io.ReadFull(reader, packet[4:]); err != nil {
+			entry.Err = ErrTruncated
+			return fn(entry)
+		}
+		p.decode(entry, packet)
+		if err = fn(entry); err != nil {
+			return err
+		}
+		position += 4 + uint64(entry.Size)
+	}
+}
+
+// check the header and checksum, and decode the messages of a valid packet
+func (p *Partition) decode(entry *Entry, packet []byte) {
+	var payload []byte
+	entry.Magic = packet[4]
+	switch {
+	case entry.Magic == 0 && len(packet) >= 9:
+		entry.Checksum = binary.BigEndian.Uint32(packet[5:9])
+		payload = packet[9:]
+	case entry.Magic == kafka.MAGIC_DEFAULT && len(packet) >= 10:
+		entry.Compression = packet[5]
+		entry.Checksum = binary.BigEndian.Uint32(packet[6:10])
+		payload = packet[10:]
+	default:
+		entry.Err = fmt.Errorf("%v: %d", ErrMagic, entry.Magic)
+		return
+	}
+	entry.Computed = crc32.ChecksumIEEE(payload)
+	if entry.Computed != entry.Checksum {
+		entry.Err = ErrChecksum
+		return
+	}
+	if _, ok := p.Codecs[entry.Compression]; !ok {
+		entry.Err = fmt.Errorf("unknown compression codec: %d", entry.Compression)
+		return
+	}
+	_, entry.Messages = kafka.Decode(packet, p.Codecs)
+}
@@ -0,0 +1,116 @@
+/*
+ *  Copyright (c) 2011 NeuStar, Inc.
+ *  All rights reserved.
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  NeuStar, the Neustar logo and related names and logos are registered
+ *  trademarks, service marks or tradenames of NeuStar, Inc. All other
+ *  product names, company names, marks, logos and symbols may be trademarks
+ *  of their respective owners.
+ */
+
+package segment
+
+import (
+	"bytes"
+	kafka "github.com/apache/kafka/clients/gokafka"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// written by the scala broker with magic 0 messages
+const testLogDir = "../../../core/src/test/resources/test-kafka-logs/MagicByte0-0"
+
+func TestWalkMagic0Segment(t *testing.T) {
+	partition, err := Open(testLogDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(partition.Segments) != 1 || partition.Segments[0].BaseOffset != 0 {
+		t.Fatalf("expected 1 segment at offset 0 but got %d", len(partition.Segments))
+	}
+
+	var ct int
+	var nextOffset uint64
+	err = partition.Walk(func(entry *Entry) error {
+		if entry.Err != nil {
+			t.Fatalf("unexpected error at %d: %v", entry.Offset, entry.Err)
+		}
+		if entry.Offset != nextOffset || entry.Magic != 0 || len(entry.Messages) != 1 {
+			t.Fatalf("entry incorrect at %d: %+v", nextOffset, entry)
+		}
+		if !bytes.Equal(entry.Messages[0].Payload(), bytes.Repeat([]byte("x"), 100)) {
+			t.Fatalf("payload incorrect at %d", entry.Offset)
+		}
+		nextOffset = entry.NextOffset()
+		ct++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct != 100 || nextOffset != 10900 {
+		t.Fatalf("expected 100 messages ending at 10900 but got %d ending at %d", ct, nextOffset)
+	}
+}
+
+func TestWalkCorruptSegments(t *testing.T) {
+	dir := t.TempDir()
+	good := kafka.NewMessage([]byte("testing")).Encode()
+	corrupt := kafka.NewMessage([]byte("testing")).Encode()
+	corrupt[len(corrupt)-1] = 'G'
+	compressed := kafka.NewCompressedMessages(kafka.NewMessage([]byte("multiple")), kafka.NewMessage([]byte("messages"))).Encode()
+
+	first := append(append(append([]byte{}, good...), corrupt...), compressed...)
+	second := append(append([]byte{}, good...), good[:8]...)
+	secondOffset := len(first)
+	writeSegment(t, dir, 0, first)
+	writeSegment(t, dir, uint64(secondOffset), second)
+
+	partition, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := make([]*Entry, 0)
+	if err = partition.Walk(func(entry *Entry) error {
+		entries = append(entries, entry)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 5 {
+		t.Fatalf("expected 5 entries but got %d", len(entries))
+	}
+	if entries[1].Err != ErrChecksum || entries[1].Offset != uint64(len(good)) {
+		t.Fatalf("expected checksum error at %d but got %v at %d", len(good), entries[1].Err, entries[1].Offset)
+	}
+	if entries[2].Err != nil || entries[2].Compression != kafka.GZIP_COMPRESSION_ID || len(entries[2].Messages) != 2 {
+		t.Fatalf("compressed entry incorrect %+v", entries[2])
+	}
+	if entries[3].Offset != uint64(secondOffset) || entries[3].Err != nil {
+		t.Fatalf("second segment entry incorrect %+v", entries[3])
+	}
+	if entries[4].Err != ErrTruncated {
+		t.Fatalf("expected truncated entry but got %v", entries[4].Err)
+	}
+}
+
+func writeSegment(t *testing.T, dir string, offset uint64, data []byte) {
+	name := filepath.Join(dir, FileName(offset))
+	if err := ioutil.WriteFile(name, data, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+}
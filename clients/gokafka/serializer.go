@@ -0,0 +1,174 @@
+/*
+ *  Copyright (c) 2011 NeuStar, Inc.
+ *  All rights reserved.
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  NeuStar, the Neustar logo and related names and logos are registered
+ *  trademarks, service marks or tradenames of NeuStar, Inc. All other
+ *  product names, company names, marks, logos and symbols may be trademarks
+ *  of their respective owners.
+ */
+
+package kafka
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Encoder serializes values into message payloads, like the scala serializer.Encoder
+type Encoder[T any] interface {
+	Encode(value T) ([]byte, error)
+}
+
+// Decoder deserializes message payloads, like the scala serializer.Decoder
+type Decoder[T any] interface {
+	Decode(payload []byte) (T, error)
+}
+
+// passes payloads through untouched
+type BytesEncoder struct{}
+
+func (BytesEncoder) Encode(value []byte) ([]byte, error) { return value, nil }
+
+type BytesDecoder struct{}
+
+func (BytesDecoder) Decode(payload []byte) ([]byte, error) { return payload, nil }
+
+type StringEncoder struct{}
+
+func (StringEncoder) Encode(value string) ([]byte, error) { return []byte(value), nil }
+
+type StringDecoder struct{}
+
+func (StringDecoder) Decode(payload []byte) (string, error) { return string(payload), nil }
+
+type JSONEncoder[T any] struct{}
+
+func (JSONEncoder[T]) Encode(value T) ([]byte, error) { return json.Marshal(value) }
+
+type JSONDecoder[T any] struct{}
+
+func (JSONDecoder[T]) Decode(payload []byte) (T, error) {
+	var value T
+	err := json.Unmarshal(payload, &value)
+	return value, err
+}
+
+// ProtoMessage is implemented by generated protobuf messages (gogoprotobuf and
+// others generate Marshal/Unmarshal), PT is the pointer to the message struct T
+type ProtoMessage[T any] interface {
+	*T
+	Marshal() ([]byte, error)
+	Unmarshal(data []byte) error
+}
+
+// serializes protobuf messages to their wire bytes
+type ProtoEncoder[T any, PT ProtoMessage[T]] struct{}
+
+func (ProtoEncoder[T, PT]) Encode(value PT) ([]byte, error) { return value.Marshal() }
+
+type ProtoDecoder[T any, PT ProtoMessage[T]] struct{}
+
+func (ProtoDecoder[T, PT]) Decode(payload []byte) (PT, error) {
+	value := PT(new(T))
+	err := value.Unmarshal(payload)
+	return value, err
+}
+
+// a publisher of typed values
+type TypedPublisher[T any] struct {
+	Publisher *BrokerPublisher
+	Encoder   Encoder[T]
+}
+
+func NewTypedPublisher[T any](publisher *BrokerPublisher, encoder Encoder[T]) *TypedPublisher[T] {
+	return &TypedPublisher[T]{Publisher: publisher, Encoder: encoder}
+}
+
+// encode and publish the values in one request, nothing is sent if any fail to encode
+func (p *TypedPublisher[T]) Publish(values ...T) (int, error) {
+	messages := make([]*Message, len(values))
+	for i, value := range values {
+		payload, err := p.Encoder.Encode(value)
+		if err != nil {
+			return -1, err
+		}
+		messages[i] = NewMessage(payload)
+	}
+	return p.Publisher.BatchPublish(messages...)
+}
+
+// a MessageSender (see NewBufferedSender) for typed values
+type TypedSender[T any] func(topic string, value T) error
+
+func NewTypedSender[T any](sender MessageSender, encoder Encoder[T]) TypedSender[T] {
+	return func(topic string, value T) error {
+		payload, err := encoder.Encode(value)
+		if err != nil {
+			return err
+		}
+		sender(NewMessageTopic(topic, payload))
+		return nil
+	}
+}
+
+type TypedHandlerFunc[T any] func(topic string, partition int, value T, msg *Message)
+
+// called with messages that could not be decoded
+type DecodeErrorHandlerFunc func(topic string, partition int, msg *Message, err error)
+
+// a consumer of typed values, messages that fail to decode go to the ErrorHandler
+// and consumption continues
+type TypedConsumer[T any] struct {
+	Consumer     *BrokerConsumer
+	Decoder      Decoder[T]
+	ErrorHandler DecodeErrorHandlerFunc
+}
+
+// Create a typed consumer, by default decode errors are logged to the consumers Logger
+func NewTypedConsumer[T any](consumer *BrokerConsumer, decoder Decoder[T]) *TypedConsumer[T] {
+	c := &TypedConsumer[T]{Consumer: consumer, Decoder: decoder}
+	c.ErrorHandler = func(topic string, partition int, msg *Message, err error) {
+		consumer.broker.Logger.Error("could not decode message", "topic", topic, "partition", partition,
+			"offset", msg.Offset(), "err", err)
+	}
+	return c
+}
+
+func (c *TypedConsumer[T]) Consume(handler TypedHandlerFunc[T]) (int, error) {
+	return c.Consumer.Consume(c.HandlerFunc(handler))
+}
+
+// adapt a typed handler to a MessageHandlerFunc, for use with the other consume methods
+func (c *TypedConsumer[T]) HandlerFunc(handler TypedHandlerFunc[T]) MessageHandlerFunc {
+	return func(topic string, partition int, msg *Message) {
+		value, err := c.decode(msg)
+		if err != nil {
+			c.ErrorHandler(topic, partition, msg, err)
+			return
+		}
+		handler(topic, partition, value, msg)
+	}
+}
+
+// decode, turning a panicking decoder into an error
+func (c *TypedConsumer[T]) decode(msg *Message) (value T, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("decoder panic: %v", r)
+		}
+	}()
+	return c.Decoder.Decode(msg.Payload())
+}
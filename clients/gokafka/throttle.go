@@ -0,0 +1,74 @@
+/*
+ *  Copyright (c) 2011 NeuStar, Inc.
+ *  All rights reserved.
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  NeuStar, the Neustar logo and related names and logos are registered
+ *  trademarks, service marks or tradenames of NeuStar, Inc. All other
+ *  product names, company names, marks, logos and symbols may be trademarks
+ *  of their respective owners.
+ */
+
+package kafka
+
+import (
+	"sync"
+	"time"
+)
+
+// Throttler limits the rate of messages and bytes per second through a producer
+// or consumer, like the scala kafka.utils.Throttler. A nil Throttler never waits
+type Throttler struct {
+	// max messages per second, 0 is unlimited
+	MessagesPerSec int
+	// max bytes per second, 0 is unlimited
+	BytesPerSec int
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+func NewThrottler(messagesPerSec, bytesPerSec int) *Throttler {
+	return &Throttler{MessagesPerSec: messagesPerSec, BytesPerSec: bytesPerSec}
+}
+
+// Account for msgs and bytes, sleeping long enough to keep under both limits.
+// Time not used while idle isn't saved up, so there are no bursts after a pause
+func (t *Throttler) Wait(msgs, bytes int) {
+	if t == nil || (t.MessagesPerSec <= 0 && t.BytesPerSec <= 0) {
+		return
+	}
+	var cost time.Duration
+	if t.MessagesPerSec > 0 {
+		cost = time.Duration(msgs) * time.Second / time.Duration(t.MessagesPerSec)
+	}
+	if t.BytesPerSec > 0 {
+		if byteCost := time.Duration(bytes) * time.Second / time.Duration(t.BytesPerSec); byteCost > cost {
+			cost = byteCost
+		}
+	}
+
+	t.mu.Lock()
+	now := time.Now()
+	if t.next.Before(now) {
+		t.next = now
+	}
+	t.next = t.next.Add(cost)
+	sleep := t.next.Sub(now)
+	t.mu.Unlock()
+
+	if sleep > 0 {
+		time.Sleep(sleep)
+	}
+}
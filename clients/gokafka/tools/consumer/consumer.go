@@ -1,10 +1,10 @@
 /*
  *  Copyright (c) 2011 NeuStar, Inc.
- *  All rights reserved.  
+ *  All rights reserved.
  *
  *  Licensed under the Apache License, Version 2.0 (the "License");
  *  you may not use this file except in compliance with the License.
- *  You may obtain a copy of the License at 
+ *  You may obtain a copy of the License at
  *
  *      http://www.apache.org/licenses/LICENSE-2.0
  *
@@ -13,9 +13,9 @@
  *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
  *  See the License for the specific language governing permissions and
  *  limitations under the License.
- *  
+ *
  *  NeuStar, the Neustar logo and related names and logos are registered
- *  trademarks, service marks or tradenames of NeuStar, Inc. All other 
+ *  trademarks, service marks or tradenames of NeuStar, Inc. All other
  *  product names, company names, marks, logos and symbols may be trademarks
  *  of their respective owners.
  */
@@ -23,158 +23,259 @@
 package main
 
 import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
-	"log"
-	"os"
-	//"os/signal"
 	kafka "github.com/apache/kafka/clients/gokafka"
+	"github.com/apache/kafka/clients/gokafka/zkutils"
+	"io"
+	"log"
 	"math"
-	"strconv"
-	"strings"
+	"os"
+	"os/signal"
 	"time"
-	//"syscall"
+	"unicode/utf8"
 )
 
+/*
+Console consumer, prints the messages of a topic's partitions to stdout (or -writeto):
+
+	./consumer -topic=test -partitions=0,1 -from-beginning
+
+-format is raw (payload per line), hex, base64 or json (payload with topic, partition
+and offset).  It stops after -msgct messages, with -until-latest once it reaches the
+offsets that were the latest when it started, or on ctrl-c:
+
+	./consumer -topic=test -from-time=2013-01-03T10:00:00Z -until-latest -format=json
+
+With -group the consumer starts from the offsets the group committed to zookeeper
+(unless a start is given) and commits its position every -commitinterval and on exit:
+
+	./consumer -topic=test -group=console -zookeeper=localhost:2181
+*/
 var hostname string
 var topic string
 var partitionstr string
 var offset uint64
+var fromBeginning bool
+var fromTime string
+var untilLatest bool
 var maxSize uint
 var maxMsgCt uint64
+var format string
 var writePayloadsTo string
-var consumerForever bool
-var printmessage bool
+var pollMs int64
+var rate int
+var byteRate int
+var group string
+var zkConnect string
+var brokerId int
+var commitInterval time.Duration
 
 func init() {
 	flag.StringVar(&hostname, "hostname", "localhost:9092", "host:port string for the kafka server")
-	flag.StringVar(&topic, "topic", "test", "topic to publish to")
-	flag.StringVar(&partitionstr, "partitions", "0", "partitions to publish to:  comma delimited")
+	flag.StringVar(&topic, "topic", "test", "topic to consume")
+	flag.StringVar(&partitionstr, "partitions", "0", "partitions to consume: comma delimited")
 	flag.Uint64Var(&offset, "offset", 0, "offset to start consuming from")
+	flag.BoolVar(&fromBeginning, "from-beginning", false, "start from the smallest offset available")
+	flag.StringVar(&fromTime, "from-time", "", "start from the log segment written before this time (RFC3339)")
+	flag.BoolVar(&untilLatest, "until-latest", false, "stop at the latest offsets when the consumer started")
 	flag.UintVar(&maxSize, "maxsize", 1048576, "max size in bytes to consume a message set")
 	flag.Uint64Var(&maxMsgCt, "msgct", math.MaxUint64, "max number of messages to read")
-	flag.StringVar(&writePayloadsTo, "writeto", "", "write payloads to this file")
-	flag.BoolVar(&consumerForever, "consumeforever", true, "loop forever consuming")
-	flag.BoolVar(&printmessage, "print", true, "print the message details to stdout")
-	log.SetOutput(os.Stdout)
+	flag.StringVar(&format, "format", "raw", "output format: raw, hex, base64 or json")
+	flag.StringVar(&writePayloadsTo, "writeto", "", "write messages to this file instead of stdout")
+	flag.Int64Var(&pollMs, "poll", 1000, "ms to wait between polls when there are no messages")
+	flag.IntVar(&rate, "rate", 0, "max messages consumed per second, 0 is unlimited")
+	flag.IntVar(&byteRate, "byterate", 0, "max bytes consumed per second, 0 is unlimited")
+	flag.StringVar(&group, "group", "", "consumer group to start from and commit offsets to")
+	flag.StringVar(&zkConnect, "zookeeper", "localhost:2181", "zookeeper connect string, for -group")
+	flag.IntVar(&brokerId, "brokerid", 0, "id of the broker in zookeeper, for -group")
+	flag.DurationVar(&commitInterval, "commitinterval", 10*time.Second, "how often to commit offsets to the group")
+	log.SetOutput(os.Stderr)
 	log.SetFlags(log.Ltime | log.Lshortfile)
 }
 
+// the json output format
+type jsonMessage struct {
+	Topic     string `json:"topic"`
+	Partition int    `json:"partition"`
+	Offset    uint64 `json:"offset"`
+	Size      int    `json:"size"`
+	Encoding  string `json:"encoding,omitempty"`
+	Payload   string `json:"payload"`
+}
+
+func writeMessage(out io.Writer, topic string, partition int, msg *kafka.Message) error {
+	payload := msg.Payload()
+	var err error
+	switch format {
+	case "raw":
+		_, err = fmt.Fprintf(out, "%s\n", payload)
+	case "hex":
+		_, err = fmt.Fprintln(out, hex.EncodeToString(payload))
+	case "base64":
+		_, err = fmt.Fprintln(out, base64.StdEncoding.EncodeToString(payload))
+	case "json":
+		jm := jsonMessage{Topic: topic, Partition: partition, Offset: msg.Offset(), Size: len(payload)}
+		if utf8.Valid(payload) {
+			jm.Payload = string(payload)
+		} else {
+			jm.Encoding, jm.Payload = "base64", base64.StdEncoding.EncodeToString(payload)
+		}
+		var line []byte
+		if line, err = json.Marshal(&jm); err == nil {
+			_, err = fmt.Fprintf(out, "%s\n", line)
+		}
+	}
+	return err
+}
+
 func main() {
 	flag.Parse()
-	fmt.Println("Consuming Messages :")
-	fmt.Printf("From: %s, topic: %s, partitions: %s\n", hostname, topic, partitionstr)
-	log.Println("printing ?", printmessage)
-	//panic("wt")
-	fmt.Println(" ---------------------- ")
-	var broker *kafka.BrokerConsumer
-
-	parts := strings.Split(partitionstr, ",")
-	if len(parts) > 1 {
-		tps := kafka.NewTopicPartitions(topic, partitionstr, offset, uint32(maxSize))
-		broker = kafka.NewMultiConsumer(hostname, tps)
-	} else {
-		partition, _ := strconv.Atoi(partitionstr)
-		//parti := []int{partition}
-		broker = kafka.NewBrokerConsumer(hostname, topic, partition, offset, uint32(maxSize))
-		//log.Printf("Kafka Consume: h=%s t='%s' Offset=%d parts=%v max=%d", hostname, topic, offset, parti, maxSize)
-		//broker = kafka.NewConsumerPartitions(hostname, topic, parti, offset, uint32(maxSize))
+	switch format {
+	case "raw", "hex", "base64", "json":
+	default:
+		fmt.Println("Error: unknown format ", format)
+		os.Exit(1)
 	}
 
-	var payloadFile *os.File = nil
-	var msgCt int
-	if len(writePayloadsTo) > 0 {
+	var zkClient *zkutils.ZkClient
+	if len(group) > 0 {
 		var err error
-		payloadFile, err = os.Create(writePayloadsTo)
-		if err != nil {
-			fmt.Println("Error opening file: ", err)
-			payloadFile = nil
+		if zkClient, err = zkutils.Connect(zkConnect, 10*time.Second); err != nil {
+			fmt.Println("Error: ", err)
+			os.Exit(1)
+		}
+		defer zkClient.Close()
+	}
+
+	tplist := kafka.NewTopicPartitions(topic, partitionstr, offset, uint32(maxSize))
+	if len(tplist) == 0 {
+		fmt.Println("Error: no partitions to consume")
+		os.Exit(1)
+	}
+	var startTime time.Time
+	if len(fromTime) > 0 {
+		var err error
+		if startTime, err = time.Parse(time.RFC3339, fromTime); err != nil {
+			fmt.Println("Error: invalid -from-time ", err)
+			os.Exit(1)
 		}
 	}
-	var consumerCallback kafka.MessageHandlerFunc
-	consumerCallback = func(topic string, partition int, msg *kafka.Message) {
-		msgCt++
-		if uint64(msgCt) > maxMsgCt {
-			panic("ending")
+	endOffsets := make(map[int]uint64)
+	lookupOffset := func(tp *kafka.TopicPartition, offsetTime int64) uint64 {
+		found, err := kafka.GetOffsetBefore(hostname, tp, offsetTime)
+		if err != nil {
+			fmt.Println("Error getting offset: ", err)
+			os.Exit(1)
 		}
-		if printmessage {
-			msg.Print()
-		} else if msgCt == 1000 {
-			fmt.Printf("Cur Offset: %d\n", msg.Offset()+msg.TotalLen())
-			msgCt = 0
+		return found
+	}
+	for _, tp := range tplist {
+		switch {
+		case fromBeginning:
+			tp.Offset = lookupOffset(tp, -2)
+		case len(fromTime) > 0:
+			tp.Offset = lookupOffset(tp, startTime.UnixNano()/int64(time.Millisecond))
+		case zkClient != nil && offset == 0:
+			committed, err := zkClient.Offset(group, topic, zkutils.BrokerPartition{BrokerId: brokerId, Partition: tp.Partition})
+			if err != nil {
+				fmt.Println("Error: ", err)
+				os.Exit(1)
+			}
+			tp.Offset = committed
 		}
-		if msgCt == 10 {
-			//panic("out")
+		if untilLatest {
+			endOffsets[tp.Partition] = lookupOffset(tp, -1)
 		}
-		if payloadFile != nil {
-			payloadFile.Write([]byte("Message at: " + strconv.FormatUint(msg.Offset(), 10) + "\n"))
-			payloadFile.Write(msg.Payload())
-			payloadFile.Write([]byte("\n-------------------------------\n"))
+	}
+
+	var out io.Writer = os.Stdout
+	if len(writePayloadsTo) > 0 {
+		file, err := os.Create(writePayloadsTo)
+		if err != nil {
+			fmt.Println("Error opening file: ", err)
+			os.Exit(1)
 		}
+		defer file.Close()
+		out = file
 	}
+	writer := bufio.NewWriter(out)
+	defer writer.Flush()
+
+	fmt.Fprintf(os.Stderr, "Consuming from: %s, topic: %s, partitions: %s\n", hostname, topic, partitionstr)
+	fmt.Fprintln(os.Stderr, " ---------------------- ")
 
-	if consumerForever {
-
-		//quit := make(chan bool, 1)
-		done := make(chan bool, 1)
-		msgChan := make(chan *kafka.Message)
-		/*
-		   go func() {
-		     var sigIn chan os.Signal = make(chan os.Signal,1)
-		     signal.Notify(sigIn)
-		     for {
-
-		       select {
-		       case <-quit:
-		         log.Println("got quit, shutting down")
-		         close(msgChan)
-		         return
-		       case sig := <-sigIn:
-		         if sig.(os.Signal) == syscall.SIGINT {
-		           done <- true
-		         } else {
-		           fmt.Println(sig)
-		         }
-		       }
-		     }
-		   }()
-		*/
-		// lets try restarting this every 1 minute to see if it works?
-		timer := time.NewTicker(time.Second * 20)
-		runConsumer := func(donech chan bool, mch chan *kafka.Message) {
-			partition, _ := strconv.Atoi(partitionstr)
-			log.Println(hostname, topic, partition, offset, uint32(maxSize))
-			brok := kafka.NewBrokerConsumer(hostname, topic, partition, offset, uint32(maxSize))
-			go brok.ConsumeOnChannel(mch, 1000, donech)
-			for msg := range mch {
-				if msg != nil {
-					consumerCallback(topic, 0, msg)
-				} else {
-					break
-				}
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt)
+
+	// the offset to commit for each partition, after the last message written
+	positions := make(map[int]uint64)
+	for _, tp := range tplist {
+		positions[tp.Partition] = tp.Offset
+	}
+	commit := func() {
+		if zkClient == nil {
+			return
+		}
+		for partition, position := range positions {
+			bp := zkutils.BrokerPartition{BrokerId: brokerId, Partition: partition}
+			if err := zkClient.SetOffset(group, topic, bp, position); err != nil {
+				log.Println("could not commit offset: ", err)
 			}
 		}
-		//go func() {
-		go runConsumer(done, msgChan)
-		for _ = range timer.C {
-			// old done channel? 
-			log.Println("about to send done signal!")
-			done <- true
-			log.Println("after done signal")
-			time.Sleep(time.Second * 2)
-			done = make(chan bool, 1)
-			mch := make(chan *kafka.Message)
-			log.Println("restarting")
-			runConsumer(done, mch)
+	}
+	lastCommit := time.Now()
+
+	broker := kafka.NewMultiConsumer(hostname, tplist)
+	broker.SetThrottle(kafka.NewThrottler(rate, byteRate))
+	var msgCt uint64
+	stopped := false
+	for !stopped {
+		select {
+		case <-quit:
+			stopped = true
+			continue
+		default:
 		}
-		//}()
 
-	} else {
-		broker.Consume(consumerCallback)
-	}
+		num, err := broker.ConsumeMetadata(func(mm *kafka.MessageAndMetadata) {
+			end, bounded := endOffsets[mm.Partition]
+			if stopped || msgCt >= maxMsgCt || (bounded && mm.Offset >= end) {
+				return
+			}
+			if err := writeMessage(writer, mm.Topic, mm.Partition, mm.Message); err != nil {
+				log.Println("write error: ", err)
+				stopped = true
+				return
+			}
+			positions[mm.Partition] = mm.NextOffset
+			msgCt++
+		})
+		if err != nil && err != io.EOF {
+			log.Println("consume error: ", err)
+		}
 
-	if payloadFile != nil {
-		payloadFile.Close()
-	}
+		reachedEnd := untilLatest
+		for _, tp := range tplist {
+			if positions[tp.Partition] < endOffsets[tp.Partition] {
+				reachedEnd = false
+			}
+		}
+		stopped = stopped || reachedEnd || msgCt >= maxMsgCt
 
+		writer.Flush()
+		if time.Since(lastCommit) > commitInterval {
+			commit()
+			lastCommit = time.Now()
+		}
+		if num <= 0 && !stopped {
+			time.Sleep(time.Duration(pollMs) * time.Millisecond)
+		}
+	}
+	commit()
+	fmt.Fprintf(os.Stderr, "consumed %d messages\n", msgCt)
 }
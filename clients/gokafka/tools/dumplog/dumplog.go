@@ -0,0 +1,164 @@
+/*
+ *  Copyright (c) 2011 NeuStar, Inc.
+ *  All rights reserved.
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  NeuStar, the Neustar logo and related names and logos are registered
+ *  trademarks, service marks or tradenames of NeuStar, Inc. All other
+ *  product names, company names, marks, logos and symbols may be trademarks
+ *  of their respective owners.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/apache/kafka/clients/gokafka/segment"
+	"os"
+	"path/filepath"
+)
+
+/*
+Dumps the messages of a partition directory, without a running broker:
+
+	./dumplog -dir=/tmp/kafka-logs/test-0
+
+Export each message as a json line, including its payload:
+
+	./dumplog -dir=/tmp/kafka-logs/test-0 -json -payloads -out=/tmp/test-0.json
+
+Only report corrupt (bad checksum, truncated) messages:
+
+	./dumplog -dir=/tmp/kafka-logs/test-0 -corrupt
+*/
+var dir string
+var asJson bool
+var payloads bool
+var onlyCorrupt bool
+var outFile string
+
+func init() {
+	flag.StringVar(&dir, "dir", "", "partition directory containing <offset>.kafka segment files")
+	flag.BoolVar(&asJson, "json", false, "write a json line per message")
+	flag.BoolVar(&payloads, "payloads", false, "include the message payloads")
+	flag.BoolVar(&onlyCorrupt, "corrupt", false, "only output corrupt messages")
+	flag.StringVar(&outFile, "out", "", "write to this file instead of stdout")
+}
+
+type jsonEntry struct {
+	Segment     string   `json:"segment"`
+	Offset      uint64   `json:"offset"`
+	NextOffset  uint64   `json:"next_offset"`
+	Size        uint32   `json:"size"`
+	Magic       byte     `json:"magic"`
+	Compression byte     `json:"compression"`
+	Checksum    uint32   `json:"checksum"`
+	Valid       bool     `json:"valid"`
+	Error       string   `json:"error,omitempty"`
+	Messages    int      `json:"messages"`
+	Payloads    []string `json:"payloads,omitempty"`
+}
+
+func main() {
+	flag.Parse()
+	if len(dir) == 0 {
+		fmt.Println("Error: -dir is required")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	partition, err := segment.Open(dir)
+	if err != nil {
+		fmt.Println("Error: ", err)
+		os.Exit(1)
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	if len(outFile) > 0 {
+		file, err := os.Create(outFile)
+		if err != nil {
+			fmt.Println("Error: ", err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		out = bufio.NewWriter(file)
+	}
+
+	var entryCt, msgCt, corruptCt int
+	encoder := json.NewEncoder(out)
+	err = partition.Walk(func(entry *segment.Entry) error {
+		entryCt++
+		msgCt += len(entry.Messages)
+		if entry.Corrupt() {
+			corruptCt++
+		} else if onlyCorrupt {
+			return nil
+		}
+		if asJson {
+			return encoder.Encode(toJson(entry))
+		}
+		printEntry(out, entry)
+		return nil
+	})
+	out.Flush()
+	if err != nil {
+		fmt.Println("Error: ", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "%s: %d segments, %d entries, %d messages, %d corrupt\n",
+		dir, len(partition.Segments), entryCt, msgCt, corruptCt)
+	if corruptCt > 0 {
+		os.Exit(2)
+	}
+}
+
+func toJson(entry *segment.Entry) *jsonEntry {
+	je := &jsonEntry{
+		Segment:     filepath.Base(entry.Segment.Path),
+		Offset:      entry.Offset,
+		NextOffset:  entry.NextOffset(),
+		Size:        entry.Size,
+		Magic:       entry.Magic,
+		Compression: entry.Compression,
+		Checksum:    entry.Checksum,
+		Valid:       !entry.Corrupt(),
+		Messages:    len(entry.Messages),
+	}
+	if entry.Err != nil {
+		je.Error = entry.Err.Error()
+	}
+	if payloads {
+		for _, msg := range entry.Messages {
+			je.Payloads = append(je.Payloads, msg.PayloadString())
+		}
+	}
+	return je
+}
+
+func printEntry(out *bufio.Writer, entry *segment.Entry) {
+	fmt.Fprintf(out, "offset: %d size: %d magic: %d compression: %d checksum: %d valid: %v",
+		entry.Offset, entry.Size, entry.Magic, entry.Compression, entry.Checksum, !entry.Corrupt())
+	if entry.Err != nil {
+		fmt.Fprintf(out, " error: %v (computed checksum: %d)", entry.Err, entry.Computed)
+	}
+	fmt.Fprintln(out)
+	if payloads {
+		for _, msg := range entry.Messages {
+			fmt.Fprintf(out, "  payload: %s\n", msg.PayloadString())
+		}
+	}
+}
@@ -0,0 +1,132 @@
+/*
+ *  Copyright (c) 2011 NeuStar, Inc.
+ *  All rights reserved.
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  NeuStar, the Neustar logo and related names and logos are registered
+ *  trademarks, service marks or tradenames of NeuStar, Inc. All other
+ *  product names, company names, marks, logos and symbols may be trademarks
+ *  of their respective owners.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/apache/kafka/clients/gokafka/zkutils"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+/*
+Prints the lag (in bytes) of a consumer group for each partition:
+
+	./lag -zookeeper=localhost:2181 -group=mygroup -topics=test
+
+Continuous mode outputs a json line per partition every interval:
+
+	./lag -group=mygroup -continuous -interval=10s
+*/
+var zkConnect string
+var group string
+var topics string
+var continuous bool
+var interval time.Duration
+var asJson bool
+
+func init() {
+	flag.StringVar(&zkConnect, "zookeeper", "localhost:2181", "zookeeper connect string (host:port,host:port)")
+	flag.StringVar(&group, "group", "", "consumer group to check")
+	flag.StringVar(&topics, "topics", "", "topics to check, comma delimited (default: all topics of the group)")
+	flag.BoolVar(&continuous, "continuous", false, "keep checking every interval, printing json")
+	flag.DurationVar(&interval, "interval", 10*time.Second, "how often to check in continuous mode")
+	flag.BoolVar(&asJson, "json", false, "print json instead of a table")
+}
+
+type lagReport struct {
+	Time  int64                   `json:"time"`
+	Group string                  `json:"group"`
+	Lag   []*zkutils.PartitionLag `json:"partitions"`
+	Total uint64                  `json:"total"`
+}
+
+func main() {
+	flag.Parse()
+	if len(group) == 0 {
+		fmt.Println("Error: -group is required")
+		flag.Usage()
+		os.Exit(1)
+	}
+	var topicList []string
+	if len(topics) > 0 {
+		topicList = strings.Split(topics, ",")
+	}
+
+	zkClient, err := zkutils.Connect(zkConnect, 10*time.Second)
+	if err != nil {
+		fmt.Println("Error: ", err)
+		os.Exit(1)
+	}
+	defer zkClient.Close()
+
+	for {
+		lags, err := zkClient.GroupLag(group, topicList)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error: ", err)
+			if !continuous {
+				os.Exit(1)
+			}
+		} else if continuous || asJson {
+			printJson(lags)
+		} else {
+			printTable(lags)
+		}
+		if !continuous {
+			return
+		}
+		time.Sleep(interval)
+	}
+}
+
+func printJson(lags []*zkutils.PartitionLag) {
+	report := lagReport{Time: time.Now().Unix(), Group: group, Lag: lags}
+	for _, pl := range lags {
+		report.Total += pl.Lag
+	}
+	out, _ := json.Marshal(report)
+	fmt.Println(string(out))
+}
+
+func printTable(lags []*zkutils.PartitionLag) {
+	fmt.Printf("Consumer group: %s\n", group)
+	fmt.Println(" ---------------------- ")
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "Topic\tPid\tHost\tOffset\tLogSize\tLag\t")
+	var total uint64
+	for _, pl := range lags {
+		lag := fmt.Sprintf("%d", pl.Lag)
+		if len(pl.Error) > 0 {
+			lag = "error: " + pl.Error
+		}
+		fmt.Fprintf(w, "%s\t%d-%d\t%s\t%d\t%d\t%s\t\n", pl.Topic, pl.BrokerId, pl.Partition, pl.Host,
+			pl.Offset, pl.LogSize, lag)
+		total += pl.Lag
+	}
+	w.Flush()
+	fmt.Printf("Total lag: %d bytes\n", total)
+}
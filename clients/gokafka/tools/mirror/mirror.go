@@ -0,0 +1,160 @@
+/*
+ *  Copyright (c) 2011 NeuStar, Inc.
+ *  All rights reserved.
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  NeuStar, the Neustar logo and related names and logos are registered
+ *  trademarks, service marks or tradenames of NeuStar, Inc. All other
+ *  product names, company names, marks, logos and symbols may be trademarks
+ *  of their respective owners.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	kafka "github.com/apache/kafka/clients/gokafka"
+	"log"
+	"os"
+	"os/signal"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+Mirrors topics from one or more source brokers to a target broker:
+
+	./mirror -source=192.168.1.15:9092,192.168.1.16:9092 -topics=test,events \
+	    -target=10.0.0.5:9092 -targetpartitions=0,1 -checkpoint=/tmp/mirror.checkpoint
+
+Topics can be renamed on the target, and filtered with a regex:
+
+	./mirror -source=192.168.1.15:9092 -topics=test,events -whitelist="^ev" -rename=events=events_copy
+
+-codec=preserve keeps the compression of the source messages, none or gzip re-compresses
+*/
+var sources string
+var topics string
+var partitionstr string
+var whitelist string
+var rename string
+var target string
+var targetPartitions string
+var preservePartitions bool
+var codecName string
+var checkpointFile string
+var offset uint64
+var maxSize uint
+var pollMs int64
+var bufferMs int64
+var bufferSize int
+var verbose bool
+
+func init() {
+	flag.StringVar(&sources, "source", "localhost:9092", "source brokers host:port, comma delimited")
+	flag.StringVar(&topics, "topics", "test", "topics to mirror, comma delimited")
+	flag.StringVar(&partitionstr, "partitions", "0", "partitions of each topic on the source brokers: comma delimited")
+	flag.StringVar(&whitelist, "whitelist", "", "only mirror topics matching this regex")
+	flag.StringVar(&rename, "rename", "", "rename topics on the target: source=target, comma delimited")
+	flag.StringVar(&target, "target", "localhost:9093", "target broker host:port")
+	flag.StringVar(&targetPartitions, "targetpartitions", "0", "partitions to publish to on the target: comma delimited")
+	flag.BoolVar(&preservePartitions, "preservepartitions", false, "publish to the same partition as the source")
+	flag.StringVar(&codecName, "codec", "preserve", "compression on the target: preserve, none or gzip")
+	flag.StringVar(&checkpointFile, "checkpoint", "", "file to checkpoint source offsets to")
+	flag.Uint64Var(&offset, "offset", 0, "offset to start from, if there is no checkpoint")
+	flag.UintVar(&maxSize, "maxsize", 1048576, "max size in bytes to consume a message set")
+	flag.Int64Var(&pollMs, "poll", 1000, "ms to wait between polls when there are no messages")
+	flag.Int64Var(&bufferMs, "buffertime", 1000, "ms to buffer messages before publishing")
+	flag.IntVar(&bufferSize, "buffersize", 1000, "messages to buffer before publishing")
+	flag.BoolVar(&verbose, "v", false, "log the mirrors progress")
+	log.SetOutput(os.Stdout)
+	log.SetFlags(log.Ltime | log.Lshortfile)
+}
+
+func main() {
+	flag.Parse()
+
+	partitions := make([]int, 0)
+	for _, part := range strings.Split(targetPartitions, ",") {
+		if partition, err := strconv.Atoi(part); err == nil {
+			partitions = append(partitions, partition)
+		}
+	}
+	topicList := strings.Split(topics, ",")
+	targetBroker := kafka.NewRandomPartitionedBroker(target, topicList[0], partitions)
+
+	mirrorSources := make([]*kafka.MirrorSource, 0)
+	for _, hostname := range strings.Split(sources, ",") {
+		src := &kafka.MirrorSource{Hostname: hostname}
+		for _, topic := range topicList {
+			src.Topics = append(src.Topics, kafka.NewTopicPartitions(topic, partitionstr, offset, uint32(maxSize))...)
+		}
+		mirrorSources = append(mirrorSources, src)
+	}
+
+	mirror := kafka.NewMirror(targetBroker, mirrorSources...)
+	mirror.PreservePartitions = preservePartitions
+	mirror.CheckpointFile = checkpointFile
+	mirror.PollTimeoutMs = pollMs
+	mirror.BufferMaxMs = bufferMs
+	mirror.BufferMaxSize = bufferSize
+	if verbose {
+		mirror.Logger = kafka.NewStdLogger(nil, kafka.LogDebug)
+		targetBroker.Logger = mirror.Logger
+	}
+
+	if len(whitelist) > 0 {
+		re, err := regexp.Compile(whitelist)
+		if err != nil {
+			fmt.Println("Error: invalid whitelist ", err)
+			os.Exit(1)
+		}
+		mirror.Filter = re.MatchString
+	}
+	for _, pair := range strings.Split(rename, ",") {
+		if parts := strings.SplitN(pair, "=", 2); len(parts) == 2 {
+			mirror.TopicMap[parts[0]] = parts[1]
+		}
+	}
+	switch codecName {
+	case "preserve":
+	case "none":
+		mirror.Codec = kafka.DefaultCodecsMap[kafka.NO_COMPRESSION_ID]
+	case "gzip":
+		mirror.Codec = kafka.DefaultCodecsMap[kafka.GZIP_COMPRESSION_ID]
+	default:
+		fmt.Println("Error: unknown codec ", codecName)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Mirroring: %s, topics: %s, partitions: %s\n", sources, topics, partitionstr)
+	fmt.Printf("To: %s, partitions: %s\n", target, targetPartitions)
+	fmt.Println(" ---------------------- ")
+
+	quit := make(chan bool, 1)
+	go func() {
+		sigIn := make(chan os.Signal, 1)
+		signal.Notify(sigIn, os.Interrupt)
+		<-sigIn
+		fmt.Println("shutting down")
+		quit <- true
+	}()
+
+	if err := mirror.Run(quit); err != nil {
+		fmt.Println("Error: ", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,125 @@
+/*
+ *  Copyright (c) 2011 NeuStar, Inc.
+ *  All rights reserved.
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  NeuStar, the Neustar logo and related names and logos are registered
+ *  trademarks, service marks or tradenames of NeuStar, Inc. All other
+ *  product names, company names, marks, logos and symbols may be trademarks
+ *  of their respective owners.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/apache/kafka/clients/gokafka/zkutils"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+/*
+Shows the owner, committed offset, log size and lag of each partition
+for a consumer group, like the scala ConsumerOffsetChecker:
+
+	./offsetchecker -zookeeper=localhost:2181 -group=mygroup -topic=test
+
+-json outputs a json array, -brokerinfo also lists the registered brokers
+*/
+var zkConnect string
+var group string
+var topics string
+var asJson bool
+var brokerInfo bool
+
+func init() {
+	flag.StringVar(&zkConnect, "zookeeper", "localhost:2181", "zookeeper connect string (host:port,host:port)")
+	flag.StringVar(&group, "group", "", "consumer group")
+	flag.StringVar(&topics, "topic", "", "comma delimited topics (default: all topics of the group)")
+	flag.BoolVar(&asJson, "json", false, "print json instead of a table")
+	flag.BoolVar(&brokerInfo, "brokerinfo", false, "print the broker info")
+}
+
+func main() {
+	flag.Parse()
+	if len(group) == 0 {
+		fmt.Println("Error: -group is required")
+		flag.Usage()
+		os.Exit(1)
+	}
+	var topicList []string
+	if len(topics) > 0 {
+		topicList = strings.Split(topics, ",")
+	}
+
+	zkClient, err := zkutils.Connect(zkConnect, 10*time.Second)
+	if err != nil {
+		fmt.Println("Error: ", err)
+		os.Exit(1)
+	}
+	defer zkClient.Close()
+
+	lags, err := zkClient.GroupLag(group, topicList)
+	if err != nil {
+		fmt.Println("Error: ", err)
+		os.Exit(1)
+	}
+	var brokers map[int]*zkutils.BrokerInfo
+	if brokerInfo {
+		if brokers, err = zkClient.Brokers(); err != nil {
+			fmt.Println("Error: ", err)
+			os.Exit(1)
+		}
+	}
+
+	if asJson {
+		out, _ := json.MarshalIndent(map[string]interface{}{"partitions": lags, "brokers": brokers}, "", "  ")
+		fmt.Println(string(out))
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "Group\tTopic\tPid\tOffset\tlogSize\tLag\tOwner\t")
+	for _, pl := range lags {
+		owner := pl.Owner
+		if len(owner) == 0 {
+			owner = "none"
+		}
+		if len(pl.Error) > 0 {
+			fmt.Fprintf(w, "%s\t%s\t%d-%d\t%d\t%s\t%s\t%s\t\n", pl.Group, pl.Topic, pl.BrokerId, pl.Partition,
+				pl.Offset, "unknown", "error: "+pl.Error, owner)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d-%d\t%d\t%d\t%d\t%s\t\n", pl.Group, pl.Topic, pl.BrokerId, pl.Partition,
+			pl.Offset, pl.LogSize, pl.Lag, owner)
+	}
+	w.Flush()
+
+	if brokerInfo {
+		fmt.Println("BROKER INFO")
+		ids := make([]int, 0, len(brokers))
+		for id := range brokers {
+			ids = append(ids, id)
+		}
+		sort.Ints(ids)
+		for _, id := range ids {
+			fmt.Printf("%d -> %s\n", id, brokers[id].Hostname())
+		}
+	}
+}
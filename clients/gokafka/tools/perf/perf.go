@@ -0,0 +1,312 @@
+/*
+ *  Copyright (c) 2011 NeuStar, Inc.
+ *  All rights reserved.
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  NeuStar, the Neustar logo and related names and logos are registered
+ *  trademarks, service marks or tradenames of NeuStar, Inc. All other
+ *  product names, company names, marks, logos and symbols may be trademarks
+ *  of their respective owners.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	kafka "github.com/apache/kafka/clients/gokafka"
+	"log"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Performance test for the producer and consumer, like kafka-producer-perf-test.sh and
+kafka-consumer-perf-test.sh:
+
+	./perf -mode=producer -topic=perf -partitions=0,1 -messages=100000 -size=200 -batch=200 -codec=gzip -threads=4
+
+	./perf -mode=consumer -topic=perf -partitions=0,1 -messages=100000
+
+Reports MB/s and msg/s every -interval, and at the end the request latency percentiles,
+batch sizes and compression ratio (payload bytes / bytes on the wire)
+*/
+var mode string
+var hostname string
+var topic string
+var partitionstr string
+var numMessages int
+var msgSize int
+var batchSize int
+var codecName string
+var threads int
+var offset uint64
+var maxSize uint
+var idleTimeout time.Duration
+var interval time.Duration
+
+func init() {
+	flag.StringVar(&mode, "mode", "producer", "producer or consumer")
+	flag.StringVar(&hostname, "hostname", "localhost:9092", "host:port string for the kafka server")
+	flag.StringVar(&topic, "topic", "test", "topic to test")
+	flag.StringVar(&partitionstr, "partitions", "0", "partitions to test: comma delimited")
+	flag.IntVar(&numMessages, "messages", 100000, "number of messages to send or consume")
+	flag.IntVar(&msgSize, "size", 100, "producer: size in bytes of each message")
+	flag.IntVar(&batchSize, "batch", 200, "producer: messages per produce request")
+	flag.StringVar(&codecName, "codec", "none", "producer: compression codec, none or gzip")
+	flag.IntVar(&threads, "threads", 1, "producer: number of concurrent publishers")
+	flag.Uint64Var(&offset, "offset", 0, "consumer: offset to start consuming from")
+	flag.UintVar(&maxSize, "maxsize", 1048576, "consumer: max size in bytes to consume a message set")
+	flag.DurationVar(&idleTimeout, "timeout", 5*time.Second, "consumer: stop after no messages for this long")
+	flag.DurationVar(&interval, "interval", 5*time.Second, "how often to report progress")
+	log.SetOutput(os.Stdout)
+	log.SetFlags(log.Ltime | log.Lshortfile)
+}
+
+// perfStats collects what the test reports, it is also the brokers Metrics
+// so it sees the request latency and the bytes on the wire
+type perfStats struct {
+	kafka.NoopMetrics
+	mu           sync.Mutex
+	start        time.Time
+	msgs         int
+	payloadBytes int
+	wireBytes    int
+	batches      []int
+	latencies    []time.Duration
+	errors       int
+}
+
+func (s *perfStats) MessagesIn(topic string, partition int, msgs int, bytes int) {
+	s.mu.Lock()
+	s.wireBytes += bytes
+	s.mu.Unlock()
+}
+
+func (s *perfStats) MessagesOut(topic string, partition int, msgs int, bytes int) {
+	s.mu.Lock()
+	s.wireBytes += bytes
+	s.mu.Unlock()
+}
+
+func (s *perfStats) RequestLatency(requestType kafka.RequestType, d time.Duration) {
+	s.mu.Lock()
+	s.latencies = append(s.latencies, d)
+	s.mu.Unlock()
+}
+
+func (s *perfStats) RequestError(requestType kafka.RequestType, err error) {
+	s.mu.Lock()
+	s.errors++
+	s.mu.Unlock()
+}
+
+// record a batch of msgs with their uncompressed payload size
+func (s *perfStats) add(msgs, payloadBytes int) {
+	s.mu.Lock()
+	s.msgs += msgs
+	s.payloadBytes += payloadBytes
+	if msgs > 0 {
+		s.batches = append(s.batches, msgs)
+	}
+	s.mu.Unlock()
+}
+
+func (s *perfStats) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.msgs
+}
+
+func (s *perfStats) progress() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	secs := time.Since(s.start).Seconds()
+	fmt.Printf("%s  %d msgs  %.2f MB  %.2f MB/s  %.1f msg/s\n", time.Now().Format("15:04:05"), s.msgs,
+		mb(s.payloadBytes), mb(s.payloadBytes)/secs, float64(s.msgs)/secs)
+}
+
+func (s *perfStats) summary() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	secs := time.Since(s.start).Seconds()
+	fmt.Println(" ---------------------- ")
+	fmt.Printf("mode: %s  codec: %s  threads: %d  elapsed: %.2fs\n", mode, codecName, threads, secs)
+	fmt.Printf("messages: %d  %.1f msg/s\n", s.msgs, float64(s.msgs)/secs)
+	fmt.Printf("payload: %.2f MB  %.2f MB/s\n", mb(s.payloadBytes), mb(s.payloadBytes)/secs)
+	fmt.Printf("wire: %.2f MB  %.2f MB/s\n", mb(s.wireBytes), mb(s.wireBytes)/secs)
+	if s.wireBytes > 0 {
+		fmt.Printf("compression ratio: %.2f\n", float64(s.payloadBytes)/float64(s.wireBytes))
+	}
+	if len(s.batches) > 0 {
+		sort.Ints(s.batches)
+		total := 0
+		for _, b := range s.batches {
+			total += b
+		}
+		fmt.Printf("batches: %d  avg: %.1f  min: %d  max: %d msgs\n", len(s.batches),
+			float64(total)/float64(len(s.batches)), s.batches[0], s.batches[len(s.batches)-1])
+	}
+	if len(s.latencies) > 0 {
+		sort.Sort(byDuration(s.latencies))
+		fmt.Printf("latency: p50: %v  p95: %v  p99: %v  max: %v\n", percentile(s.latencies, 50),
+			percentile(s.latencies, 95), percentile(s.latencies, 99), s.latencies[len(s.latencies)-1])
+	}
+	fmt.Printf("errors: %d\n", s.errors)
+}
+
+type byDuration []time.Duration
+
+func (d byDuration) Len() int           { return len(d) }
+func (d byDuration) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+func (d byDuration) Less(i, j int) bool { return d[i] < d[j] }
+
+// the pct percentile of sorted latencies
+func percentile(sorted []time.Duration, pct int) time.Duration {
+	idx := len(sorted)*pct/100 - 1
+	if idx < 0 {
+		idx = 0
+	}
+	return sorted[idx]
+}
+
+func mb(bytes int) float64 {
+	return float64(bytes) / (1024 * 1024)
+}
+
+// a payload of random letters from a small alphabet, so it compresses like text
+func makePayload(size int, rnd *rand.Rand) []byte {
+	const letters = "abcdefghijklmnop "
+	payload := make([]byte, size)
+	for i := range payload {
+		payload[i] = letters[rnd.Intn(len(letters))]
+	}
+	return payload
+}
+
+func produce(stats *perfStats, partitions []int) {
+	var codec kafka.PayloadCodec
+	switch codecName {
+	case "none":
+	case "gzip":
+		codec = kafka.DefaultCodecsMap[kafka.GZIP_COMPRESSION_ID]
+	default:
+		fmt.Println("Error: unknown codec ", codecName)
+		os.Exit(1)
+	}
+
+	wg := new(sync.WaitGroup)
+	perThread := numMessages / threads
+	for t := 0; t < threads; t++ {
+		toSend := perThread
+		if t == 0 {
+			toSend += numMessages % threads
+		}
+		partition := partitions[t%len(partitions)]
+		wg.Add(1)
+		go func(thread, partition, toSend int) {
+			defer wg.Done()
+			publisher := kafka.NewBrokerPublisher(hostname, topic, partition)
+			publisher.SetMetrics(stats)
+			publisher.SetCompression(kafka.NewCompressionPolicy(codec))
+			rnd := rand.New(rand.NewSource(time.Now().UnixNano() + int64(thread)))
+			for sent := 0; sent < toSend; {
+				n := batchSize
+				if toSend-sent < n {
+					n = toSend - sent
+				}
+				msgs := make([]*kafka.Message, n)
+				for i := range msgs {
+					msgs[i] = kafka.NewMessage(makePayload(msgSize, rnd))
+				}
+				if _, err := publisher.BatchPublish(msgs...); err != nil {
+					log.Println("publish error: ", err)
+				} else {
+					stats.add(n, n*msgSize)
+				}
+				sent += n
+			}
+		}(t, partition, toSend)
+	}
+	wg.Wait()
+}
+
+func consume(stats *perfStats, partitions []int) {
+	wg := new(sync.WaitGroup)
+	for _, partition := range partitions {
+		wg.Add(1)
+		go func(partition int) {
+			defer wg.Done()
+			consumer := kafka.NewBrokerConsumer(hostname, topic, partition, offset, uint32(maxSize))
+			consumer.SetMetrics(stats)
+			lastMsg := time.Now()
+			for stats.count() < numMessages && time.Since(lastMsg) < idleTimeout {
+				payloadBytes := 0
+				num, _ := consumer.Consume(func(topic string, partition int, msg *kafka.Message) {
+					payloadBytes += len(msg.Payload())
+				})
+				if num > 0 {
+					stats.add(num, payloadBytes)
+					lastMsg = time.Now()
+				} else {
+					time.Sleep(100 * time.Millisecond)
+				}
+			}
+		}(partition)
+	}
+	wg.Wait()
+}
+
+func main() {
+	flag.Parse()
+	partitions := make([]int, 0)
+	for _, part := range strings.Split(partitionstr, ",") {
+		if partition, err := strconv.Atoi(part); err == nil {
+			partitions = append(partitions, partition)
+		}
+	}
+	if len(partitions) == 0 || threads < 1 || batchSize < 1 {
+		fmt.Println("Error: -partitions, -threads and -batch must be set")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	fmt.Printf("Perf %s: %s, topic: %s, partitions: %s\n", mode, hostname, topic, partitionstr)
+	fmt.Println(" ---------------------- ")
+
+	stats := &perfStats{start: time.Now()}
+	ticker := time.NewTicker(interval)
+	go func() {
+		for _ = range ticker.C {
+			stats.progress()
+		}
+	}()
+
+	switch mode {
+	case "producer":
+		produce(stats, partitions)
+	case "consumer":
+		consume(stats, partitions)
+	default:
+		fmt.Println("Error: unknown mode ", mode)
+		os.Exit(1)
+	}
+	ticker.Stop()
+	stats.summary()
+}
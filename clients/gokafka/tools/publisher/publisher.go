@@ -1,10 +1,10 @@
 /*
  *  Copyright (c) 2011 NeuStar, Inc.
- *  All rights reserved.  
+ *  All rights reserved.
  *
  *  Licensed under the Apache License, Version 2.0 (the "License");
  *  you may not use this file except in compliance with the License.
- *  You may obtain a copy of the License at 
+ *  You may obtain a copy of the License at
  *
  *      http://www.apache.org/licenses/LICENSE-2.0
  *
@@ -13,9 +13,9 @@
  *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
  *  See the License for the specific language governing permissions and
  *  limitations under the License.
- *  
+ *
  *  NeuStar, the Neustar logo and related names and logos are registered
- *  trademarks, service marks or tradenames of NeuStar, Inc. All other 
+ *  trademarks, service marks or tradenames of NeuStar, Inc. All other
  *  product names, company names, marks, logos and symbols may be trademarks
  *  of their respective owners.
  */
@@ -24,197 +24,351 @@ package main
 
 import (
 	"bufio"
+	"encoding/binary"
+	"encoding/json"
 	"flag"
 	"fmt"
 	kafka "github.com/apache/kafka/clients/gokafka"
+	"hash/fnv"
+	"io"
 	"log"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
 /*
- This publisher tool has 5 send modes:
- 1.  Pass message:   
-         ./publisher -message="good stuff bob" -hostname=192.168.1.15:9092
-
- 2.  Pass Msg, SendCT:  Send the samge message SendCt # of times 
-        ./publisher -sendct=100 -message="good stuff bob"
-
- 3.  MessageFile:  pass a message file and it will read 
-          ./publisher -messagefile=/tmp/msgs.log
-
- 4.  Stdin:  if message, message file empty it accepts 
-              messages from Console (message end at new line)
-              ./publisher -topic=atopic -partition=0
-               >my message here<enter>
-
- 5.  MultiProduce Stdin:  if message, message file empty it accepts 
-              messages from Console (message end at new line)
-              ./publisher -topic=atopic -partition=0 -multi
-               >my message here<enter>
-      each message is sent 4 times, to get more than one partition
+Console producer, reads messages from stdin (or -file) and publishes them:
+
+ 1. Pass message:
+    ./publisher -message="good stuff bob" -hostname=192.168.1.15:9092
+
+ 2. Pass Msg, SendCT:  Send the same message SendCt # of times, limit the
+    rate with -rate (messages/sec) and -byterate (bytes/sec)
+    ./publisher -sendct=100000 -message="good stuff bob" -rate=1000
+
+ 3. Text lines (default), one message per line.  -keyed splits each line into
+    key<delimiter>value, the key is hashed to choose the partition.  -partitioned
+    reads the partition as the first field:  partition<delimiter>[key<delimiter>]value
+    ./publisher -topic=atopic -partitions=0,1 -keyed -delimiter=:
+    >user1:my message here<enter>
+
+ 4. JSON lines, one object per line, value is a string or any json:
+    ./publisher -input=json -partitions=0,1 < msgs.json
+    {"key": "user1", "value": {"name": "bob"}}
+    {"partition": 1, "value": "my message here"}
+
+ 5. Binary, messages prefixed by their length (4 byte big endian uint32):
+    ./publisher -input=binary -file=/tmp/msgs.bin
+
+Messages are batched per partition up to -batch messages or -linger ms, and
+compressed per batch with -codec.  A delivery summary is printed at the end.
 */
 var hostname string
 var topic string
-var partition int
-var sendCt int
+var partitionstr string
 var message string
-var messageFile string
-var compress bool
-var multi bool
+var sendCt int
+var inputFile string
+var inputFormat string
+var keyed bool
+var partitioned bool
+var delimiter string
+var codecName string
+var batchSize int
+var lingerMs int64
+var rate int
+var byteRate int
+var verbose bool
 
 func init() {
 	flag.StringVar(&hostname, "hostname", "localhost:9092", "host:port string for the kafka server")
 	flag.StringVar(&topic, "topic", "test", "topic to publish to")
-	flag.IntVar(&partition, "partition", 0, "partition to publish to")
+	flag.StringVar(&partitionstr, "partitions", "0", "partitions to publish to: comma delimited")
 	flag.StringVar(&message, "message", "", "message to publish")
-	flag.IntVar(&sendCt, "sendct", 0, "to do a pseudo load test, set sendct & pass a message ")
-	flag.StringVar(&messageFile, "messagefile", "", "read message from this file")
-	flag.BoolVar(&compress, "compress", false, "compress the messages published")
-	flag.BoolVar(&multi, "multi", false, "send multiple messages (multiproduce)?")
-	log.SetOutput(os.Stdout)
+	flag.IntVar(&sendCt, "sendct", 1, "to do a pseudo load test, set sendct & pass a message")
+	flag.StringVar(&inputFile, "file", "", "read messages from this file instead of stdin")
+	flag.StringVar(&inputFormat, "input", "text", "input format: text, json or binary")
+	flag.BoolVar(&keyed, "keyed", false, "text lines are key<delimiter>value, the key chooses the partition")
+	flag.BoolVar(&partitioned, "partitioned", false, "text lines start with the partition: partition<delimiter>")
+	flag.StringVar(&delimiter, "delimiter", "\t", "delimiter between the partition, key and value of text lines")
+	flag.StringVar(&codecName, "codec", "none", "compression codec: none or gzip")
+	flag.IntVar(&batchSize, "batch", 200, "max messages per produce request")
+	flag.Int64Var(&lingerMs, "linger", 1000, "max ms to wait for a batch to fill before publishing")
+	flag.IntVar(&rate, "rate", 0, "max messages published per second, 0 is unlimited")
+	flag.IntVar(&byteRate, "byterate", 0, "max bytes published per second, 0 is unlimited")
+	flag.BoolVar(&verbose, "v", false, "print each message as it is read")
+	log.SetOutput(os.Stderr)
 	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
 }
 
-// sends file & exits
-func SendFile(msgFile string) {
-
-	broker := kafka.NewBrokerPublisher(hostname, topic, partition)
-
-	fmt.Println("Publishing File:", msgFile)
-	file, err := os.Open(msgFile)
-	if err != nil {
-		fmt.Println("Error: ", err)
-		return
-	}
-	stat, err := file.Stat()
-	if err != nil {
-		fmt.Println("Error: ", err)
-		return
-	}
-	payload := make([]byte, stat.Size())
-	file.Read(payload)
-	timing := kafka.StartTiming("Sending")
-
-	if compress {
-		broker.Publish(kafka.NewCompressedMessage(payload))
-	} else {
-		broker.Publish(kafka.NewMessage(payload))
-	}
-
-	timing.Print()
-	file.Close()
+// a message read from the input, partition is -1 if it should be chosen by key
+// or round robin
+type record struct {
+	partition int
+	key       string
+	payload   []byte
 }
 
-func MakeMsg(message []byte) *kafka.MessageTopic {
-	//if compress {
-	//  return kafka.NewCompressedMessage(message)
-	//} 
-	return kafka.NewMessageTopic(topic, message)
+// the json lines input format
+type jsonRecord struct {
+	Partition *int            `json:"partition"`
+	Key       string          `json:"key"`
+	Value     json.RawMessage `json:"value"`
 }
 
-// sends single message and exits
-func SendMessage() {
-
-	broker := kafka.NewBrokerPublisher(hostname, topic, partition)
-
-	fmt.Println("Publishing :", message)
-	broker.Publish(kafka.NewMessage([]byte(message)))
+// counts for the delivery summary
+type summary struct {
+	start   time.Time
+	read    int
+	invalid int
+	sent    map[int]int
+	failed  map[int]int
+	bytes   int
+	lastErr error
 }
 
-// sends x copies of a message
-func SendManyMessages() {
-
-	broker := kafka.NewBrokerPublisher(hostname, topic, partition)
-	timing := kafka.StartTiming("Sending")
-
-	fmt.Println("Publishing :", message, ": Will send ", sendCt, " times")
-	done := make(chan bool)
-	msgChan := make(chan *kafka.MessageTopic, 1000)
-
-	go broker.PublishOnChannel(msgChan, 100, 100, done)
-	for i := 0; i < sendCt; i++ {
-		msgChan <- MakeMsg([]byte(message))
+func parseText(line string) (*record, error) {
+	rec := &record{partition: -1}
+	if partitioned {
+		parts := strings.SplitN(line, delimiter, 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("missing partition")
+		}
+		partition, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid partition %q", parts[0])
+		}
+		rec.partition, line = partition, parts[1]
 	}
-	done <- true // force flush
-
-	timing.Print()
-}
-
-// sends messages from stdin
-func StdinPruducer() {
-
-	broker := kafka.NewBrokerPublisher(hostname, topic, partition)
-	b := bufio.NewReader(os.Stdin)
-	done := make(chan bool)
-	msgChan := make(chan *kafka.MessageTopic, 1000)
-
-	go broker.PublishOnChannel(msgChan, 2000, 200, done)
-	fmt.Println("reading from stdin")
-	for {
-		if s, e := b.ReadString('\n'); e == nil {
-
-			fmt.Println("sending ---", s, []byte(s))
-
-			msgChan <- MakeMsg([]byte(s)[:len(s)-1])
-
+	if keyed {
+		if parts := strings.SplitN(line, delimiter, 2); len(parts) == 2 {
+			rec.key, line = parts[0], parts[1]
 		}
 	}
+	rec.payload = []byte(line)
+	return rec, nil
 }
 
-// console producer, this sends 4 messages to the producer,
-// so that hopefully the random partition sends at least one to each partition
-func StdinMultiProduce() {
-
-	broker := kafka.NewPartitionedProducer(hostname, topic, []int{partition, partition + 1})
-	b := bufio.NewReader(os.Stdin)
-	done := make(chan bool)
-	msgChan := make(chan *kafka.MessageTopic, 1000)
-
-	go broker.PublishOnChannel(msgChan, 2000, 200, done)
-
-	fmt.Println("reading from stdin")
+func parseJson(line string) (*record, error) {
+	var jr jsonRecord
+	if err := json.Unmarshal([]byte(line), &jr); err != nil {
+		return nil, err
+	}
+	if len(jr.Value) == 0 {
+		return nil, fmt.Errorf("missing value")
+	}
+	rec := &record{partition: -1, key: jr.Key, payload: []byte(jr.Value)}
+	if jr.Partition != nil {
+		rec.partition = *jr.Partition
+	}
+	// a json string value is published as its contents, anything else as json
+	var str string
+	if json.Unmarshal(jr.Value, &str) == nil {
+		rec.payload = []byte(str)
+	}
+	return rec, nil
+}
 
-	for {
+// read the input, sending records to out until EOF, then close it
+func readInput(in io.Reader, out chan *record, stats *summary) {
+	defer close(out)
 
-		if s, e := b.ReadString('\n'); e == nil {
-			by := []byte(s)[:len(s)-1]
-			fmt.Println("sending ---", s, by)
-			// hope we get at least 1 of each random partition
-			msgChan <- MakeMsg(by)
-			msgChan <- MakeMsg(by)
-			msgChan <- MakeMsg(by)
-			msgChan <- MakeMsg(by)
+	if len(message) > 0 {
+		for i := 0; i < sendCt; i++ {
+			out <- &record{partition: -1, payload: []byte(message)}
+		}
+		return
+	}
 
+	if inputFormat == "binary" {
+		reader := bufio.NewReader(in)
+		var length uint32
+		for {
+			if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+				if err != io.EOF {
+					log.Println("invalid length prefix: ", err)
+					stats.invalid++
+				}
+				return
+			}
+			payload := make([]byte, length)
+			if _, err := io.ReadFull(reader, payload); err != nil {
+				log.Println("truncated message: ", err)
+				stats.invalid++
+				return
+			}
+			out <- &record{partition: -1, payload: payload}
 		}
+	}
 
+	parse := parseText
+	if inputFormat == "json" {
+		parse = parseJson
+	}
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if inputFormat == "json" && len(strings.TrimSpace(line)) == 0 {
+			continue
+		}
+		rec, err := parse(line)
+		if err != nil {
+			log.Printf("skipping invalid line %q: %v", line, err)
+			stats.invalid++
+			continue
+		}
+		if verbose {
+			fmt.Fprintf(os.Stderr, "read partition=%d key=%q %s\n", rec.partition, rec.key, rec.payload)
+		}
+		out <- rec
+	}
+	if err := scanner.Err(); err != nil {
+		log.Println("read error: ", err)
 	}
 }
 
 func main() {
 
 	flag.Parse()
-	fmt.Printf("Kafka: %s, topic: %s, partition: %d\n", hostname, topic, partition)
-	fmt.Println(" ---------------------- ")
-
-	if len(message) == 0 && len(messageFile) != 0 {
 
-		SendFile(messageFile)
-
-	} else if len(message) > 0 && sendCt == 0 {
-
-		SendMessage()
+	partitions := make([]int, 0)
+	for _, part := range strings.Split(partitionstr, ",") {
+		if partition, err := strconv.Atoi(part); err == nil {
+			partitions = append(partitions, partition)
+		}
+	}
+	if len(partitions) == 0 || batchSize < 1 {
+		fmt.Println("Error: -partitions and -batch must be set")
+		flag.Usage()
+		os.Exit(1)
+	}
+	var codec kafka.PayloadCodec
+	switch codecName {
+	case "none":
+	case "gzip":
+		codec = kafka.DefaultCodecsMap[kafka.GZIP_COMPRESSION_ID]
+	default:
+		fmt.Println("Error: unknown codec ", codecName)
+		os.Exit(1)
+	}
+	if inputFormat != "text" && inputFormat != "json" && inputFormat != "binary" {
+		fmt.Println("Error: unknown input format ", inputFormat)
+		os.Exit(1)
+	}
 
-	} else if len(message) > 0 && sendCt > 0 {
+	var in io.Reader = os.Stdin
+	if len(inputFile) > 0 {
+		file, err := os.Open(inputFile)
+		if err != nil {
+			fmt.Println("Error: ", err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		in = file
+	}
 
-		SendManyMessages()
+	fmt.Fprintf(os.Stderr, "Kafka: %s, topic: %s, partitions: %s\n", hostname, topic, partitionstr)
+	fmt.Fprintln(os.Stderr, " ---------------------- ")
 
-	} else if multi {
+	stats := &summary{start: time.Now(), sent: make(map[int]int), failed: make(map[int]int)}
+	throttle := kafka.NewThrottler(rate, byteRate)
+	publishers := make(map[int]*kafka.BrokerPublisher)
+	batches := make(map[int][]*kafka.Message)
 
-		StdinMultiProduce()
+	flush := func(partition int) {
+		batch := batches[partition]
+		if len(batch) == 0 {
+			return
+		}
+		delete(batches, partition)
+		publisher, ok := publishers[partition]
+		if !ok {
+			publisher = kafka.NewBrokerPublisher(hostname, topic, partition)
+			publisher.SetThrottle(throttle)
+			publisher.SetCompression(kafka.NewCompressionPolicy(codec))
+			publishers[partition] = publisher
+		}
+		if _, err := publisher.BatchPublish(batch...); err != nil {
+			log.Printf("failed to publish %d messages to partition %d: %v", len(batch), partition, err)
+			stats.failed[partition] += len(batch)
+			stats.lastErr = err
+			return
+		}
+		stats.sent[partition] += len(batch)
+		for _, msg := range batch {
+			stats.bytes += len(msg.Payload())
+		}
+	}
 
-	} else {
+	records := make(chan *record, batchSize)
+	go readInput(in, records, stats)
 
-		StdinPruducer()
+	linger := time.NewTicker(time.Duration(lingerMs) * time.Millisecond)
+	defer linger.Stop()
+	next := 0
+	for {
+		select {
+		case rec, ok := <-records:
+			if !ok {
+				for partition := range batches {
+					flush(partition)
+				}
+				printSummary(stats)
+				return
+			}
+			stats.read++
+			partition := rec.partition
+			if partition < 0 && len(rec.key) > 0 {
+				h := fnv.New32a()
+				h.Write([]byte(rec.key))
+				partition = partitions[int(h.Sum32()%uint32(len(partitions)))]
+			} else if partition < 0 {
+				partition = partitions[next%len(partitions)]
+				next++
+			}
+			batches[partition] = append(batches[partition], kafka.NewMessage(rec.payload))
+			if len(batches[partition]) >= batchSize {
+				flush(partition)
+			}
+		case <-linger.C:
+			for partition := range batches {
+				flush(partition)
+			}
+		}
+	}
+}
 
+func printSummary(stats *summary) {
+	partitions := make([]int, 0)
+	sent, failed := 0, 0
+	for partition, ct := range stats.sent {
+		partitions = append(partitions, partition)
+		sent += ct
+	}
+	for partition, ct := range stats.failed {
+		if _, ok := stats.sent[partition]; !ok {
+			partitions = append(partitions, partition)
+		}
+		failed += ct
+	}
+	sort.Ints(partitions)
+	secs := time.Since(stats.start).Seconds()
+
+	fmt.Fprintln(os.Stderr, " ---------------------- ")
+	fmt.Fprintf(os.Stderr, "read: %d  sent: %d  failed: %d  invalid: %d  in %.2fs (%.1f msg/s, %d bytes)\n",
+		stats.read, sent, failed, stats.invalid, secs, float64(sent)/secs, stats.bytes)
+	for _, partition := range partitions {
+		fmt.Fprintf(os.Stderr, "  partition %d:  sent: %d  failed: %d\n", partition, stats.sent[partition],
+			stats.failed[partition])
+	}
+	if stats.lastErr != nil {
+		fmt.Fprintln(os.Stderr, "last error: ", stats.lastErr)
+	}
+	if failed > 0 || stats.invalid > 0 {
+		os.Exit(1)
 	}
 }
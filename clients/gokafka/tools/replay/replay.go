@@ -0,0 +1,160 @@
+/*
+ *  Copyright (c) 2011 NeuStar, Inc.
+ *  All rights reserved.
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  NeuStar, the Neustar logo and related names and logos are registered
+ *  trademarks, service marks or tradenames of NeuStar, Inc. All other
+ *  product names, company names, marks, logos and symbols may be trademarks
+ *  of their respective owners.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	kafka "github.com/apache/kafka/clients/gokafka"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Replays a topic/partition between two offsets (or times) into another topic:
+
+	./replay -hostname=localhost:9092 -topic=test -start=0 -end=4096 -outputtopic=test_replay
+
+Times are RFC3339 and are rounded to the log segment they fall in, -rate limits the
+messages published per second:
+
+	./replay -topic=test -starttime=2013-01-03T10:00:00Z -outputtopic=test_replay -rate=500
+*/
+var hostname string
+var topic string
+var partition int
+var startOffset uint64
+var endOffset uint64
+var startTime string
+var endTime string
+var target string
+var outputTopic string
+var targetPartitions string
+var rate int
+var byteRate int
+var maxSize uint
+var bufferMs int64
+var bufferSize int
+var verbose bool
+
+func init() {
+	flag.StringVar(&hostname, "hostname", "localhost:9092", "host:port of the broker to read from")
+	flag.StringVar(&topic, "topic", "test", "topic to replay")
+	flag.IntVar(&partition, "partition", 0, "partition to replay")
+	flag.Uint64Var(&startOffset, "start", 0, "offset to start from")
+	flag.Uint64Var(&endOffset, "end", 0, "offset to stop before (default: the end of the log)")
+	flag.StringVar(&startTime, "starttime", "", "time (RFC3339) to start from, instead of -start")
+	flag.StringVar(&endTime, "endtime", "", "time (RFC3339) to stop at, instead of -end")
+	flag.StringVar(&target, "target", "", "host:port of the broker to publish to (default: -hostname)")
+	flag.StringVar(&outputTopic, "outputtopic", "", "topic to publish to")
+	flag.StringVar(&targetPartitions, "targetpartitions", "0", "partitions to publish to: comma delimited")
+	flag.IntVar(&rate, "rate", 0, "max messages published per second, 0 is unlimited")
+	flag.IntVar(&byteRate, "byterate", 0, "max bytes published per second, 0 is unlimited")
+	flag.UintVar(&maxSize, "maxsize", 1048576, "max size in bytes to consume a message set")
+	flag.Int64Var(&bufferMs, "buffertime", 1000, "ms to buffer messages before publishing")
+	flag.IntVar(&bufferSize, "buffersize", 1000, "messages to buffer before publishing")
+	flag.BoolVar(&verbose, "v", false, "log the replays progress")
+	log.SetOutput(os.Stdout)
+	log.SetFlags(log.Ltime | log.Lshortfile)
+}
+
+func main() {
+	flag.Parse()
+	if len(outputTopic) == 0 {
+		fmt.Println("Error: -outputtopic is required")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if len(target) == 0 {
+		target = hostname
+	}
+
+	source := &kafka.TopicPartition{Topic: topic, Partition: partition, Offset: startOffset, MaxSize: uint32(maxSize)}
+	if len(startTime) > 0 {
+		source.Offset = offsetAt(source, startTime)
+	}
+	if len(endTime) > 0 {
+		// 0 is the end of the log to the replay, not the start
+		if endOffset = offsetAt(source, endTime); endOffset == 0 {
+			fmt.Println("Error: no messages before ", endTime)
+			os.Exit(1)
+		}
+	}
+
+	partitions := make([]int, 0)
+	for _, part := range strings.Split(targetPartitions, ",") {
+		if p, err := strconv.Atoi(part); err == nil {
+			partitions = append(partitions, p)
+		}
+	}
+	targetBroker := kafka.NewRandomPartitionedBroker(target, outputTopic, partitions)
+
+	replay := kafka.NewReplay(hostname, source, targetBroker, outputTopic)
+	replay.EndOffset = endOffset
+	replay.MessagesPerSec = rate
+	replay.BytesPerSec = byteRate
+	replay.BufferMaxMs = bufferMs
+	replay.BufferMaxSize = bufferSize
+	if verbose {
+		replay.Logger = kafka.NewStdLogger(nil, kafka.LogDebug)
+		targetBroker.Logger = replay.Logger
+	}
+
+	fmt.Printf("Replaying: %s, topic: %s, partition: %d, offset: %d\n", hostname, topic, partition, source.Offset)
+	fmt.Printf("To: %s, topic: %s, partitions: %s\n", target, outputTopic, targetPartitions)
+	fmt.Println(" ---------------------- ")
+
+	quit := make(chan bool, 1)
+	go func() {
+		sigIn := make(chan os.Signal, 1)
+		signal.Notify(sigIn, os.Interrupt)
+		<-sigIn
+		fmt.Println("shutting down")
+		quit <- true
+	}()
+
+	num, err := replay.Run(quit)
+	if err != nil {
+		fmt.Println("Error: ", err)
+		os.Exit(1)
+	}
+	fmt.Printf("replayed %d messages\n", num)
+}
+
+func offsetAt(tp *kafka.TopicPartition, value string) uint64 {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		fmt.Println("Error: invalid time ", err)
+		os.Exit(1)
+	}
+	offset, err := kafka.OffsetBefore(hostname, tp, t)
+	if err != nil {
+		fmt.Println("Error: could not get the offset before ", value, err)
+		os.Exit(1)
+	}
+	return offset
+}
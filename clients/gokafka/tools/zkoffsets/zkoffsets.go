@@ -0,0 +1,137 @@
+/*
+ *  Copyright (c) 2011 NeuStar, Inc.
+ *  All rights reserved.
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  NeuStar, the Neustar logo and related names and logos are registered
+ *  trademarks, service marks or tradenames of NeuStar, Inc. All other
+ *  product names, company names, marks, logos and symbols may be trademarks
+ *  of their respective owners.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/apache/kafka/clients/gokafka/zkutils"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+/*
+Exports and imports the committed offsets of a consumer group, in the same file
+format as the scala ExportZkOffsets/ImportZkOffsets tools:
+
+	./zkoffsets -zookeeper=localhost:2181 -group=mygroup -export=offsets.txt
+
+Import them back, or into another group with -togroup (stop the group's consumers first):
+
+	./zkoffsets -import=offsets.txt -togroup=mygroup2
+*/
+var zkConnect string
+var group string
+var topics string
+var exportFile string
+var importFile string
+var toGroup string
+
+func init() {
+	flag.StringVar(&zkConnect, "zookeeper", "localhost:2181", "zookeeper connect string (host:port,host:port)")
+	flag.StringVar(&group, "group", "", "consumer group to export")
+	flag.StringVar(&topics, "topics", "", "topics to export, comma delimited (default: all topics of the group)")
+	flag.StringVar(&exportFile, "export", "", "file to export offsets to, - for stdout")
+	flag.StringVar(&importFile, "import", "", "file to import offsets from, - for stdin")
+	flag.StringVar(&toGroup, "togroup", "", "import the offsets into this group instead of the exported one")
+}
+
+func main() {
+	flag.Parse()
+	if (len(exportFile) == 0) == (len(importFile) == 0) {
+		fmt.Println("Error: one of -export or -import is required")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if len(exportFile) > 0 && len(group) == 0 {
+		fmt.Println("Error: -group is required to export")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	zkClient, err := zkutils.Connect(zkConnect, 10*time.Second)
+	if err != nil {
+		fmt.Println("Error: ", err)
+		os.Exit(1)
+	}
+	defer zkClient.Close()
+
+	if len(exportFile) > 0 {
+		err = export(zkClient)
+	} else {
+		err = load(zkClient)
+	}
+	if err != nil {
+		fmt.Println("Error: ", err)
+		os.Exit(1)
+	}
+}
+
+func export(zkClient *zkutils.ZkClient) error {
+	var topicList []string
+	if len(topics) > 0 {
+		topicList = strings.Split(topics, ",")
+	}
+	offsets, err := zkClient.ExportOffsets(group, topicList)
+	if err != nil {
+		return err
+	}
+
+	var out io.Writer = os.Stdout
+	if exportFile != "-" {
+		file, err := os.Create(exportFile)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+	if err = zkutils.WriteOffsets(out, offsets); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "exported %d offsets for group %s\n", len(offsets), group)
+	return nil
+}
+
+func load(zkClient *zkutils.ZkClient) error {
+	var in io.Reader = os.Stdin
+	if importFile != "-" {
+		file, err := os.Open(importFile)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		in = file
+	}
+	offsets, err := zkutils.ReadOffsets(in)
+	if err != nil {
+		return err
+	}
+	if err = zkClient.ImportOffsets(offsets, toGroup); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "imported %d offsets\n", len(offsets))
+	return nil
+}
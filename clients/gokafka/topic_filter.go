@@ -0,0 +1,76 @@
+/*
+ *  Copyright (c) 2011 NeuStar, Inc.
+ *  All rights reserved.
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  NeuStar, the Neustar logo and related names and logos are registered
+ *  trademarks, service marks or tradenames of NeuStar, Inc. All other
+ *  product names, company names, marks, logos and symbols may be trademarks
+ *  of their respective owners.
+ */
+
+package kafka
+
+import (
+	"regexp"
+	"strings"
+)
+
+// TopicFilter chooses topics to consume, like the scala consumers TopicFilter
+type TopicFilter interface {
+	Matches(topic string) bool
+}
+
+// compile a filter spec, commas are alternatives as in the scala whitelist:  "test,events.*"
+func compileTopicFilter(spec string) (*regexp.Regexp, error) {
+	spec = strings.Replace(strings.TrimSpace(spec), ",", "|", -1)
+	spec = strings.Replace(spec, " ", "", -1)
+	spec = strings.Trim(spec, `"'`)
+	// topics must match the whole expression
+	return regexp.Compile("^(?:" + spec + ")$")
+}
+
+// a filter allowing only topics matching the regex
+type Whitelist struct {
+	Regexp *regexp.Regexp
+}
+
+func NewWhitelist(spec string) (*Whitelist, error) {
+	re, err := compileTopicFilter(spec)
+	if err != nil {
+		return nil, err
+	}
+	return &Whitelist{Regexp: re}, nil
+}
+
+func (w *Whitelist) Matches(topic string) bool {
+	return w.Regexp.MatchString(topic)
+}
+
+// a filter allowing every topic except those matching the regex
+type Blacklist struct {
+	Regexp *regexp.Regexp
+}
+
+func NewBlacklist(spec string) (*Blacklist, error) {
+	re, err := compileTopicFilter(spec)
+	if err != nil {
+		return nil, err
+	}
+	return &Blacklist{Regexp: re}, nil
+}
+
+func (b *Blacklist) Matches(topic string) bool {
+	return !b.Regexp.MatchString(topic)
+}
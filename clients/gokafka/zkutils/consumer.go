@@ -0,0 +1,142 @@
+/*
+ *  Copyright (c) 2011 NeuStar, Inc.
+ *  All rights reserved.
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  NeuStar, the Neustar logo and related names and logos are registered
+ *  trademarks, service marks or tradenames of NeuStar, Inc. All other
+ *  product names, company names, marks, logos and symbols may be trademarks
+ *  of their respective owners.
+ */
+
+package zkutils
+
+import (
+	"errors"
+	"fmt"
+	kafka "github.com/apache/kafka/clients/gokafka"
+	"time"
+)
+
+// Connect to the zookeeper of a consumer config (zk.connect, zk.sessiontimeout.ms)
+func ConnectWithConfig(config *kafka.ConsumerConfig) (*ZkClient, error) {
+	if len(config.ZkConnect) == 0 {
+		return nil, errors.New("zk.connect is required")
+	}
+	return Connect(config.ZkConnect, time.Duration(config.ZkSessionTimeoutMs)*time.Millisecond)
+}
+
+// Create a consumer from config for partitions of topic on broker brokerId (all of the
+// brokers partitions of the topic if none are given), looking the broker up in zookeeper.
+// Each partition starts from the offset committed for groupid, or from autooffset.reset
+// if the group has not committed one
+func (c *ZkClient) NewConsumerWithConfig(config *kafka.ConsumerConfig, topic string, brokerId int,
+	partitions ...int) (*kafka.BrokerConsumer, error) {
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	if len(config.GroupId) == 0 {
+		return nil, errors.New("groupid is required")
+	}
+	broker, err := c.Broker(brokerId)
+	if err != nil {
+		return nil, fmt.Errorf("could not find broker %d: %v", brokerId, err)
+	}
+	if len(partitions) == 0 {
+		bps, err := c.TopicPartitions(topic)
+		if err != nil {
+			return nil, err
+		}
+		for _, bp := range bps {
+			if bp.BrokerId == brokerId {
+				partitions = append(partitions, bp.Partition)
+			}
+		}
+		if len(partitions) == 0 {
+			return nil, fmt.Errorf("broker %d has no partitions of %s", brokerId, topic)
+		}
+	}
+	committed, err := c.Offsets(config.GroupId, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	tplist := make([]*kafka.TopicPartition, len(partitions))
+	for tpi, part := range partitions {
+		tplist[tpi] = &kafka.TopicPartition{Topic: topic, Partition: part, MaxSize: uint32(config.FetchSize)}
+	}
+	err = startOffsets(tplist, brokerId, committed, func(tp *kafka.TopicPartition) (uint64, error) {
+		return kafka.GetOffsetBefore(broker.Hostname(), tp, config.ResetOffsetTime())
+	})
+	if err != nil {
+		return nil, err
+	}
+	consumer := kafka.NewMultiConsumer(broker.Hostname(), tplist)
+	config.SetSocketOptions(consumer)
+	return consumer, nil
+}
+
+// set the offset of each topic/partition to the committed offset, or the reset offset if
+// there isn't one
+func startOffsets(tplist []*kafka.TopicPartition, brokerId int, committed map[BrokerPartition]uint64,
+	reset func(tp *kafka.TopicPartition) (uint64, error)) error {
+
+	for _, tp := range tplist {
+		if offset, ok := committed[BrokerPartition{brokerId, tp.Partition}]; ok {
+			tp.Offset = offset
+			continue
+		}
+		offset, err := reset(tp)
+		if err != nil {
+			return fmt.Errorf("could not get the reset offset of %s-%d: %v", tp.Topic, tp.Partition, err)
+		}
+		tp.Offset = offset
+	}
+	return nil
+}
+
+// Commit the offset of each topic/partition for group
+func (c *ZkClient) CommitOffsets(group string, brokerId int, tplist ...*kafka.TopicPartition) error {
+	for _, tp := range tplist {
+		if err := c.SetOffset(group, tp.Topic, BrokerPartition{brokerId, tp.Partition}, tp.Offset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Commit the positions for groupid every autocommit.interval.ms until quit, and once more on
+// quit, if autocommit.enable is set.  positions returns the offsets that are safe to commit,
+// e.g. ParallelConsumer.Committed
+func (c *ZkClient) AutoCommit(config *kafka.ConsumerConfig, brokerId int, positions func() []*kafka.TopicPartition,
+	quit chan bool) error {
+
+	if !config.AutoCommit {
+		<-quit
+		return nil
+	}
+	ticker := time.NewTicker(time.Duration(config.AutoCommitIntervalMs) * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-quit:
+			return c.CommitOffsets(config.GroupId, brokerId, positions()...)
+		case <-ticker.C:
+			if err := c.CommitOffsets(config.GroupId, brokerId, positions()...); err != nil {
+				return err
+			}
+		}
+	}
+}
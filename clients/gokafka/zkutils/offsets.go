@@ -0,0 +1,143 @@
+/*
+ *  Copyright (c) 2011 NeuStar, Inc.
+ *  All rights reserved.
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  NeuStar, the Neustar logo and related names and logos are registered
+ *  trademarks, service marks or tradenames of NeuStar, Inc. All other
+ *  product names, company names, marks, logos and symbols may be trademarks
+ *  of their respective owners.
+ */
+
+package zkutils
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A committed offset of a consumer group for one broker partition, the unit of the
+// export/import file format
+type GroupOffset struct {
+	Group string
+	Topic string
+	BrokerPartition
+	Offset uint64
+}
+
+// the zookeeper path of the offset, which is also the key used in export files
+func (o *GroupOffset) Path() string {
+	return path.Join(ConsumerOffsetDir(o.Group, o.Topic), o.BrokerPartition.String())
+}
+
+// Parse one line of an offset export file, in the same format as the scala
+// ExportZkOffsets tool:   /consumers/<group>/offsets/<topic>/<brokerid>-<partition>:<offset>
+func ParseGroupOffset(line string) (*GroupOffset, error) {
+	idx := strings.LastIndex(line, ":")
+	if idx < 0 {
+		return nil, fmt.Errorf("invalid offset line %q", line)
+	}
+	offset, err := strconv.ParseUint(strings.TrimSpace(line[idx+1:]), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid offset line %q: %v", line, err)
+	}
+	parts := strings.Split(strings.Trim(line[:idx], "/"), "/")
+	if len(parts) != 5 || "/"+parts[0] != ConsumersPath || parts[2] != "offsets" {
+		return nil, fmt.Errorf("invalid offset path in %q", line)
+	}
+	bp, err := ParseBrokerPartition(parts[4])
+	if err != nil {
+		return nil, err
+	}
+	return &GroupOffset{Group: parts[1], Topic: parts[3], BrokerPartition: bp, Offset: offset}, nil
+}
+
+// Write offsets to w, one per line in the ExportZkOffsets format
+func WriteOffsets(w io.Writer, offsets []*GroupOffset) error {
+	for _, o := range offsets {
+		if _, err := fmt.Fprintf(w, "%s:%d\n", o.Path(), o.Offset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Read offsets written by WriteOffsets (or the scala ExportZkOffsets), blank lines
+// and lines starting with # are skipped
+func ReadOffsets(r io.Reader) ([]*GroupOffset, error) {
+	offsets := make([]*GroupOffset, 0)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		o, err := ParseGroupOffset(line)
+		if err != nil {
+			return nil, err
+		}
+		offsets = append(offsets, o)
+	}
+	return offsets, scanner.Err()
+}
+
+// Get all the committed offsets of a consumer group, sorted by topic and broker
+// partition. If no topics are passed all the topics of the group are exported
+func (c *ZkClient) ExportOffsets(group string, topics []string) ([]*GroupOffset, error) {
+	var err error
+	if len(topics) == 0 {
+		if topics, err = c.GroupTopics(group); err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(topics)
+	offsets := make([]*GroupOffset, 0)
+	for _, topic := range topics {
+		topicOffsets, err := c.Offsets(group, topic)
+		if err != nil {
+			return nil, err
+		}
+		bps := make([]BrokerPartition, 0, len(topicOffsets))
+		for bp := range topicOffsets {
+			bps = append(bps, bp)
+		}
+		sort.Sort(byBrokerPartition(bps))
+		for _, bp := range bps {
+			offsets = append(offsets, &GroupOffset{Group: group, Topic: topic, BrokerPartition: bp, Offset: topicOffsets[bp]})
+		}
+	}
+	return offsets, nil
+}
+
+// Commit the offsets to zookeeper. If group is not empty the offsets are written
+// to that group instead of the one they were exported from, which is how a group
+// is copied or migrated. Consumers of the group should be stopped first, as running
+// consumers will overwrite the offsets on their next commit
+func (c *ZkClient) ImportOffsets(offsets []*GroupOffset, group string) error {
+	for _, o := range offsets {
+		g := o.Group
+		if len(group) > 0 {
+			g = group
+		}
+		if err := c.SetOffset(g, o.Topic, o.BrokerPartition, o.Offset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
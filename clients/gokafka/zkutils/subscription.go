@@ -0,0 +1,210 @@
+/*
+ *  Copyright (c) 2011 NeuStar, Inc.
+ *  All rights reserved.
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  NeuStar, the Neustar logo and related names and logos are registered
+ *  trademarks, service marks or tradenames of NeuStar, Inc. All other
+ *  product names, company names, marks, logos and symbols may be trademarks
+ *  of their respective owners.
+ */
+
+package zkutils
+
+import (
+	"errors"
+	kafka "github.com/apache/kafka/clients/gokafka"
+	"io"
+	"sync"
+	"time"
+)
+
+// Subscription consumes every topic matching a TopicFilter, watching /brokers/topics
+// so topics (and new broker partitions of a topic) are picked up without a restart.
+// One consumer is created per broker for each topic, the Handler is never called
+// concurrently.
+type Subscription struct {
+	zkClient *ZkClient
+	Filter   kafka.TopicFilter
+	Handler  kafka.MessageHandlerFunc
+
+	// partitions start from the offsets committed for Group when it's set, the others
+	// from the offset before OffsetTime: -2 the earliest (the default), -1 the latest
+	// or a time in ms
+	Group      string
+	OffsetTime int64
+	MaxSize    uint32
+
+	PollTimeoutMs int64
+	// re-check the partitions of subscribed topics this often, new brokers for a
+	// topic don't change the /brokers/topics children we watch
+	RefreshInterval time.Duration
+	Logger          kafka.Logger
+
+	mu        sync.Mutex
+	handlerMu sync.Mutex
+	started   map[subscribedPartition]bool
+	wg        sync.WaitGroup
+}
+
+func NewSubscription(zkClient *ZkClient, filter kafka.TopicFilter, maxSize uint32, handler kafka.MessageHandlerFunc) *Subscription {
+	return &Subscription{
+		zkClient:        zkClient,
+		Filter:          filter,
+		Handler:         handler,
+		OffsetTime:      -2,
+		MaxSize:         maxSize,
+		PollTimeoutMs:   1000,
+		RefreshInterval: time.Minute,
+		Logger:          kafka.NoopLogger{},
+		started:         make(map[subscribedPartition]bool),
+	}
+}
+
+// the topics being consumed
+func (s *Subscription) Topics() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seen := make(map[string]bool)
+	topics := make([]string, 0)
+	for key := range s.started {
+		if !seen[key.Topic] {
+			seen[key.Topic] = true
+			topics = append(topics, key.Topic)
+		}
+	}
+	return topics
+}
+
+type subscribedPartition struct {
+	Topic string
+	BrokerPartition
+}
+
+// Run the subscription, blocking until quit receives
+func (s *Subscription) Run(quit chan bool) error {
+	stop := make(chan bool)
+	defer func() {
+		close(stop)
+		s.wg.Wait()
+	}()
+
+	for {
+		topics, _, events, err := s.zkClient.Conn.ChildrenW(BrokerTopicsPath)
+		if err != nil {
+			return err
+		}
+		for _, topic := range topics {
+			if s.Filter.Matches(topic) {
+				if err = s.subscribe(topic, stop); err != nil {
+					s.Logger.Error("could not subscribe", "topic", topic, "err", err)
+				}
+			}
+		}
+
+		select {
+		case <-quit:
+			return nil
+		case event := <-events:
+			s.Logger.Debug("topics changed", "path", event.Path, "type", event.Type)
+		case <-time.After(s.RefreshInterval):
+		}
+	}
+}
+
+// start consumers for the partitions of topic we aren't consuming yet, partitions on
+// brokers or with start offsets that can't be looked up are left for the next refresh
+func (s *Subscription) subscribe(topic string, stop chan bool) error {
+	partitions, err := s.zkClient.TopicPartitions(topic)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	newPartitions := make(map[int][]*kafka.TopicPartition)
+	for _, bp := range partitions {
+		key := subscribedPartition{topic, bp}
+		if s.started[key] {
+			continue
+		}
+		s.started[key] = true
+		tp := &kafka.TopicPartition{Topic: topic, Partition: bp.Partition, MaxSize: s.MaxSize}
+		newPartitions[bp.BrokerId] = append(newPartitions[bp.BrokerId], tp)
+	}
+	s.mu.Unlock()
+
+	var committed map[BrokerPartition]uint64
+	if len(s.Group) > 0 && len(newPartitions) > 0 {
+		if committed, err = s.zkClient.Offsets(s.Group, topic); err != nil {
+			s.forget(topic, newPartitions)
+			return err
+		}
+	}
+
+	var errs []error
+	for brokerId, tplist := range newPartitions {
+		broker, err := s.zkClient.Broker(brokerId)
+		if err == nil {
+			err = startOffsets(tplist, brokerId, committed, func(tp *kafka.TopicPartition) (uint64, error) {
+				return kafka.GetOffsetBefore(broker.Hostname(), tp, s.OffsetTime)
+			})
+		}
+		if err != nil {
+			s.forget(topic, map[int][]*kafka.TopicPartition{brokerId: tplist})
+			errs = append(errs, err)
+			continue
+		}
+		s.Logger.Info("subscribing", "topic", topic, "host", broker.Hostname(), "partitions", len(tplist))
+		consumer := kafka.NewMultiConsumer(broker.Hostname(), tplist)
+		consumer.SetLogger(s.Logger)
+		s.wg.Add(1)
+		go s.consume(consumer, stop)
+	}
+	return errors.Join(errs...)
+}
+
+// forget partitions that could not be started, so the next refresh tries again
+func (s *Subscription) forget(topic string, partitions map[int][]*kafka.TopicPartition) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for brokerId, tplist := range partitions {
+		for _, tp := range tplist {
+			delete(s.started, subscribedPartition{topic, BrokerPartition{brokerId, tp.Partition}})
+		}
+	}
+}
+
+func (s *Subscription) consume(consumer *kafka.BrokerConsumer, stop chan bool) {
+	defer s.wg.Done()
+	pollDuration := time.Duration(s.PollTimeoutMs) * time.Millisecond
+	handler := func(topic string, partition int, msg *kafka.Message) {
+		s.handlerMu.Lock()
+		s.Handler(topic, partition, msg)
+		s.handlerMu.Unlock()
+	}
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		num, err := consumer.Consume(handler)
+		if err != nil && err != io.EOF {
+			s.Logger.Error("subscription consume failed", "err", err)
+		}
+		if num <= 0 {
+			time.Sleep(pollDuration)
+		}
+	}
+}
@@ -0,0 +1,400 @@
+/*
+ *  Copyright (c) 2011 NeuStar, Inc.
+ *  All rights reserved.
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  NeuStar, the Neustar logo and related names and logos are registered
+ *  trademarks, service marks or tradenames of NeuStar, Inc. All other
+ *  product names, company names, marks, logos and symbols may be trademarks
+ *  of their respective owners.
+ */
+
+// Package zkutils reads and writes the kafka zookeeper registry (brokers, topics
+// and consumer group offsets), using the same layout as the scala kafka.utils.ZkUtils
+package zkutils
+
+import (
+	"errors"
+	"fmt"
+	kafka "github.com/apache/kafka/clients/gokafka"
+	"github.com/samuel/go-zookeeper/zk"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ConsumersPath    = "/consumers"
+	BrokerIdsPath    = "/brokers/ids"
+	BrokerTopicsPath = "/brokers/topics"
+)
+
+// a registered broker:  /brokers/ids/<id> = <creator>:<host>:<port>
+type BrokerInfo struct {
+	Id      int
+	Creator string
+	Host    string
+	Port    int
+}
+
+// host:port of the broker
+func (b *BrokerInfo) Hostname() string {
+	return fmt.Sprintf("%s:%d", b.Host, b.Port)
+}
+
+func ParseBrokerInfo(id int, data string) (*BrokerInfo, error) {
+	parts := strings.Split(data, ":")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid broker info for %d: %q", id, data)
+	}
+	port, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid broker port for %d: %q", id, data)
+	}
+	return &BrokerInfo{Id: id, Creator: parts[0], Host: parts[1], Port: port}, nil
+}
+
+// a partition on a specific broker, written <brokerid>-<partition> in zookeeper
+type BrokerPartition struct {
+	BrokerId  int
+	Partition int
+}
+
+func (bp BrokerPartition) String() string {
+	return fmt.Sprintf("%d-%d", bp.BrokerId, bp.Partition)
+}
+
+func ParseBrokerPartition(name string) (BrokerPartition, error) {
+	parts := strings.Split(name, "-")
+	if len(parts) != 2 {
+		return BrokerPartition{}, fmt.Errorf("invalid broker partition %q", name)
+	}
+	brokerId, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return BrokerPartition{}, fmt.Errorf("invalid broker partition %q", name)
+	}
+	partition, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return BrokerPartition{}, fmt.Errorf("invalid broker partition %q", name)
+	}
+	return BrokerPartition{BrokerId: brokerId, Partition: partition}, nil
+}
+
+type byBrokerPartition []BrokerPartition
+
+func (p byBrokerPartition) Len() int      { return len(p) }
+func (p byBrokerPartition) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p byBrokerPartition) Less(i, j int) bool {
+	if p[i].BrokerId != p[j].BrokerId {
+		return p[i].BrokerId < p[j].BrokerId
+	}
+	return p[i].Partition < p[j].Partition
+}
+
+func ConsumerOffsetDir(group, topic string) string {
+	return path.Join(ConsumersPath, group, "offsets", topic)
+}
+
+func ConsumerOwnerDir(group, topic string) string {
+	return path.Join(ConsumersPath, group, "owners", topic)
+}
+
+func ConsumerRegistryDir(group string) string {
+	return path.Join(ConsumersPath, group, "ids")
+}
+
+var ErrNoBroker = errors.New("broker is not registered")
+
+// a connection to the zookeeper cluster kafka is registered in
+type ZkClient struct {
+	Conn *zk.Conn
+}
+
+// Connect to zookeeper, zkConnect is the comma delimited host:port list used by
+// the zk.connect property
+func Connect(zkConnect string, sessionTimeout time.Duration) (*ZkClient, error) {
+	conn, _, err := zk.Connect(strings.Split(zkConnect, ","), sessionTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetLogger(noopZkLogger{})
+	return &ZkClient{Conn: conn}, nil
+}
+
+func (c *ZkClient) Close() {
+	c.Conn.Close()
+}
+
+type noopZkLogger struct{}
+
+func (noopZkLogger) Printf(string, ...interface{}) {}
+
+// children of a path, an empty list if it doesn't exist
+func (c *ZkClient) children(zkPath string) ([]string, error) {
+	children, _, err := c.Conn.Children(zkPath)
+	if err == zk.ErrNoNode {
+		return []string{}, nil
+	}
+	sort.Strings(children)
+	return children, err
+}
+
+// Get the registered brokers by id
+func (c *ZkClient) Brokers() (map[int]*BrokerInfo, error) {
+	ids, err := c.children(BrokerIdsPath)
+	if err != nil {
+		return nil, err
+	}
+	brokers := make(map[int]*BrokerInfo, len(ids))
+	for _, idStr := range ids {
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			continue
+		}
+		broker, err := c.Broker(id)
+		if err == ErrNoBroker {
+			// de-registered since we listed them
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		brokers[id] = broker
+	}
+	return brokers, nil
+}
+
+func (c *ZkClient) Broker(id int) (*BrokerInfo, error) {
+	data, _, err := c.Conn.Get(path.Join(BrokerIdsPath, strconv.Itoa(id)))
+	if err == zk.ErrNoNode {
+		return nil, ErrNoBroker
+	} else if err != nil {
+		return nil, err
+	}
+	return ParseBrokerInfo(id, string(data))
+}
+
+// Get all of the topics registered by brokers
+func (c *ZkClient) Topics() ([]string, error) {
+	return c.children(BrokerTopicsPath)
+}
+
+// Get the partitions of a topic, /brokers/topics/<topic>/<brokerid> holds the number of
+// partitions that broker has for the topic
+func (c *ZkClient) TopicPartitions(topic string) ([]BrokerPartition, error) {
+	topicPath := path.Join(BrokerTopicsPath, topic)
+	brokerIds, err := c.children(topicPath)
+	if err != nil {
+		return nil, err
+	}
+	partitions := make([]BrokerPartition, 0)
+	for _, idStr := range brokerIds {
+		brokerId, err := strconv.Atoi(idStr)
+		if err != nil {
+			continue
+		}
+		data, _, err := c.Conn.Get(path.Join(topicPath, idStr))
+		if err == zk.ErrNoNode {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		ct, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil {
+			return nil, fmt.Errorf("invalid partition count for %s/%s: %q", topic, idStr, data)
+		}
+		for partition := 0; partition < ct; partition++ {
+			partitions = append(partitions, BrokerPartition{BrokerId: brokerId, Partition: partition})
+		}
+	}
+	return partitions, nil
+}
+
+// Get the topics a consumer group has committed offsets for
+func (c *ZkClient) GroupTopics(group string) ([]string, error) {
+	return c.children(path.Join(ConsumersPath, group, "offsets"))
+}
+
+// Get the committed offsets of a consumer group for a topic
+func (c *ZkClient) Offsets(group, topic string) (map[BrokerPartition]uint64, error) {
+	offsetDir := ConsumerOffsetDir(group, topic)
+	names, err := c.children(offsetDir)
+	if err != nil {
+		return nil, err
+	}
+	offsets := make(map[BrokerPartition]uint64, len(names))
+	for _, name := range names {
+		bp, err := ParseBrokerPartition(name)
+		if err != nil {
+			continue
+		}
+		offset, err := c.Offset(group, topic, bp)
+		if err != nil {
+			return nil, err
+		}
+		offsets[bp] = offset
+	}
+	return offsets, nil
+}
+
+// Get the committed offset of a consumer group for a single broker partition, 0
+// if it has never committed
+func (c *ZkClient) Offset(group, topic string, bp BrokerPartition) (uint64, error) {
+	data, _, err := c.Conn.Get(path.Join(ConsumerOffsetDir(group, topic), bp.String()))
+	if err == zk.ErrNoNode {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// Get the consumer thread that owns a broker partition for a group, empty if it is not owned
+func (c *ZkClient) Owner(group, topic string, bp BrokerPartition) (string, error) {
+	data, _, err := c.Conn.Get(path.Join(ConsumerOwnerDir(group, topic), bp.String()))
+	if err == zk.ErrNoNode {
+		return "", nil
+	}
+	return string(data), err
+}
+
+// Commit an offset for a consumer group, creating the path if needed
+func (c *ZkClient) SetOffset(group, topic string, bp BrokerPartition, offset uint64) error {
+	return c.setData(path.Join(ConsumerOffsetDir(group, topic), bp.String()), []byte(strconv.FormatUint(offset, 10)))
+}
+
+// set the data of a persistent node, creating it and its parents if they don't exist
+func (c *ZkClient) setData(zkPath string, data []byte) error {
+	_, err := c.Conn.Set(zkPath, data, -1)
+	if err != zk.ErrNoNode {
+		return err
+	}
+	if err = c.createParents(path.Dir(zkPath)); err != nil {
+		return err
+	}
+	_, err = c.Conn.Create(zkPath, data, 0, zk.WorldACL(zk.PermAll))
+	if err == zk.ErrNodeExists {
+		_, err = c.Conn.Set(zkPath, data, -1)
+	}
+	return err
+}
+
+func (c *ZkClient) createParents(zkPath string) error {
+	if zkPath == "/" {
+		return nil
+	}
+	exists, _, err := c.Conn.Exists(zkPath)
+	if err != nil || exists {
+		return err
+	}
+	if err = c.createParents(path.Dir(zkPath)); err != nil {
+		return err
+	}
+	_, err = c.Conn.Create(zkPath, []byte{}, 0, zk.WorldACL(zk.PermAll))
+	if err == zk.ErrNodeExists {
+		return nil
+	}
+	return err
+}
+
+// The lag of a consumer group for one broker partition, offsets are byte positions
+// in the log so lag is in bytes
+type PartitionLag struct {
+	Group     string `json:"group"`
+	Topic     string `json:"topic"`
+	BrokerId  int    `json:"brokerid"`
+	Partition int    `json:"partition"`
+	Host      string `json:"host"`
+	Offset    uint64 `json:"offset"`
+	LogSize   uint64 `json:"logsize"`
+	Lag       uint64 `json:"lag"`
+	Owner     string `json:"owner"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Get the lag and owner of a consumer group for each partition of the given topics, if no
+// topics are passed all the topics the group has committed offsets for are used
+func (c *ZkClient) GroupLag(group string, topics []string) ([]*PartitionLag, error) {
+	var err error
+	if len(topics) == 0 {
+		if topics, err = c.GroupTopics(group); err != nil {
+			return nil, err
+		}
+	}
+	brokers, err := c.Brokers()
+	if err != nil {
+		return nil, err
+	}
+
+	lags := make([]*PartitionLag, 0)
+	for _, topic := range topics {
+		offsets, err := c.Offsets(group, topic)
+		if err != nil {
+			return nil, err
+		}
+		partitions, err := c.TopicPartitions(topic)
+		if err != nil {
+			return nil, err
+		}
+		// include partitions with committed offsets whose broker is no longer registered
+		seen := make(map[BrokerPartition]bool, len(partitions))
+		for _, bp := range partitions {
+			seen[bp] = true
+		}
+		for bp := range offsets {
+			if !seen[bp] {
+				partitions = append(partitions, bp)
+			}
+		}
+		sort.Sort(byBrokerPartition(partitions))
+
+		for _, bp := range partitions {
+			pl := &PartitionLag{Group: group, Topic: topic, BrokerId: bp.BrokerId, Partition: bp.Partition, Offset: offsets[bp]}
+			if pl.Owner, err = c.Owner(group, topic, bp); err != nil {
+				return nil, err
+			}
+			broker, ok := brokers[bp.BrokerId]
+			if !ok {
+				pl.Error = ErrNoBroker.Error()
+				lags = append(lags, pl)
+				continue
+			}
+			pl.Host = broker.Hostname()
+			logSize, err := LogSize(pl.Host, topic, bp.Partition)
+			if err != nil {
+				pl.Error = err.Error()
+			} else {
+				pl.LogSize = logSize
+				if logSize > pl.Offset {
+					pl.Lag = logSize - pl.Offset
+				}
+			}
+			lags = append(lags, pl)
+		}
+	}
+	return lags, nil
+}
+
+// Get the latest offset of a partition from its broker
+func LogSize(hostname, topic string, partition int) (uint64, error) {
+	offsets, err := kafka.NewBrokerOffsetConsumer(hostname, topic, partition).GetOffsets(-1, 1)
+	if err != nil {
+		return 0, err
+	}
+	if len(offsets) == 0 {
+		return 0, nil
+	}
+	return offsets[0], nil
+}
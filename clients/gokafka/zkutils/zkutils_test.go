@@ -0,0 +1,124 @@
+/*
+ *  Copyright (c) 2011 NeuStar, Inc.
+ *  All rights reserved.
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  NeuStar, the Neustar logo and related names and logos are registered
+ *  trademarks, service marks or tradenames of NeuStar, Inc. All other
+ *  product names, company names, marks, logos and symbols may be trademarks
+ *  of their respective owners.
+ */
+
+package zkutils
+
+import (
+	"bytes"
+	"errors"
+	kafka "github.com/apache/kafka/clients/gokafka"
+	"strings"
+	"testing"
+)
+
+func TestParseBrokerInfo(t *testing.T) {
+	broker, err := ParseBrokerInfo(1, "192.168.1.25-1357240800000:192.168.1.25:9092")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if broker.Id != 1 || broker.Creator != "192.168.1.25-1357240800000" || broker.Hostname() != "192.168.1.25:9092" {
+		t.Fatalf("broker info incorrect %+v", broker)
+	}
+	if _, err = ParseBrokerInfo(1, "192.168.1.25:9092"); err == nil {
+		t.Fatalf("expected error for missing creator")
+	}
+}
+
+func TestBrokerPartition(t *testing.T) {
+	bp, err := ParseBrokerPartition("3-12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bp.BrokerId != 3 || bp.Partition != 12 || bp.String() != "3-12" {
+		t.Fatalf("broker partition incorrect %+v", bp)
+	}
+	for _, name := range []string{"3", "3-a", "a-3", "1-2-3"} {
+		if _, err = ParseBrokerPartition(name); err == nil {
+			t.Fatalf("expected error parsing %q", name)
+		}
+	}
+	if ConsumerOffsetDir("group1", "test") != "/consumers/group1/offsets/test" {
+		t.Fatalf("offset dir incorrect %s", ConsumerOffsetDir("group1", "test"))
+	}
+}
+
+func TestGroupOffsets(t *testing.T) {
+	offsets := []*GroupOffset{
+		&GroupOffset{Group: "group1", Topic: "test", BrokerPartition: BrokerPartition{0, 0}, Offset: 1024},
+		&GroupOffset{Group: "group1", Topic: "test", BrokerPartition: BrokerPartition{1, 3}, Offset: 0},
+	}
+	var buf bytes.Buffer
+	if err := WriteOffsets(&buf, offsets); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "/consumers/group1/offsets/test/0-0:1024\n/consumers/group1/offsets/test/1-3:0\n" {
+		t.Fatalf("export format incorrect %q", buf.String())
+	}
+
+	read, err := ReadOffsets(strings.NewReader("# exported\n" + buf.String() + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != 2 || *read[0] != *offsets[0] || *read[1] != *offsets[1] {
+		t.Fatalf("offsets did not round trip %+v", read)
+	}
+
+	for _, line := range []string{"/consumers/group1/offsets/test/0-0", "/consumers/group1/owners/test/0-0:1",
+		"/consumers/group1/offsets/test/0:1", "/consumers/group1/offsets/test/0-0:x"} {
+		if _, err = ParseGroupOffset(line); err == nil {
+			t.Fatalf("expected error parsing %q", line)
+		}
+	}
+}
+
+func TestStartOffsets(t *testing.T) {
+	tplist := []*kafka.TopicPartition{{Topic: "test", Partition: 0}, {Topic: "test", Partition: 1}}
+	committed := map[BrokerPartition]uint64{{BrokerId: 2, Partition: 1}: 4096, {BrokerId: 3, Partition: 0}: 1}
+	reset := func(tp *kafka.TopicPartition) (uint64, error) { return 512, nil }
+	if err := startOffsets(tplist, 2, committed, reset); err != nil {
+		t.Fatal(err)
+	}
+	if tplist[0].Offset != 512 || tplist[1].Offset != 4096 {
+		t.Fatalf("expected the reset offset without a committed one, got %d %d", tplist[0].Offset, tplist[1].Offset)
+	}
+
+	// a subscription without a group has no committed offsets
+	if err := startOffsets(tplist, 2, nil, reset); err != nil || tplist[1].Offset != 512 {
+		t.Fatalf("expected the reset offset without a group, got %d %v", tplist[1].Offset, err)
+	}
+
+	failing := func(tp *kafka.TopicPartition) (uint64, error) { return 0, errors.New("connection refused") }
+	if err := startOffsets(tplist, 2, committed, failing); err == nil {
+		t.Fatalf("expected the reset offset error to be returned")
+	}
+
+	sub := NewSubscription(nil, nil, 1024, nil)
+	if sub.OffsetTime != -2 {
+		t.Fatalf("new partitions should start from the earliest offset by default")
+	}
+	sub.started[subscribedPartition{"test", BrokerPartition{2, 0}}] = true
+	sub.started[subscribedPartition{"test", BrokerPartition{2, 1}}] = true
+	sub.forget("test", map[int][]*kafka.TopicPartition{2: tplist[:1]})
+	if len(sub.started) != 1 || !sub.started[subscribedPartition{"test", BrokerPartition{2, 1}}] {
+		t.Fatalf("only the forgotten partition should be restarted %v", sub.started)
+	}
+}